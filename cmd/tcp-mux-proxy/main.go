@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/wish/tcp-mux-proxy/pkg/healthmonitor"
@@ -12,6 +16,8 @@ import (
 func main() {
 	// Get the configuration data
 	var configLocation = flag.String("c", "config.yaml", "Path to the yaml configuration file")
+	var watchInterval = flag.Duration("watch", 0, "Interval at which to poll the configuration file for changes (0 disables watching, SIGHUP always reloads)")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests in flight on SIGINT or SIGTERM before exiting")
 	flag.Parse()
 	config, err := healthmonitor.ParseConfig(*configLocation)
 	if err != nil {
@@ -20,27 +26,76 @@ func main() {
 
 	rand.Seed(time.Now().UnixNano())
 
-	// Initialize proxy and health monitor
-	proxy := healthmonitor.NewProxyServer(&config)
-	healthMonitor := healthmonitor.NewHealthMonitor(&config, proxy)
+	proxy, err := healthmonitor.New(&config)
+	if err != nil {
+		log.Fatalf("Could not create proxy: %v\n", err)
+	}
+	go reloadConfig(*configLocation, *watchInterval, proxy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go shutdownOnSignal(*shutdownTimeout, proxy, cancel)
+
+	if err := proxy.Run(ctx); err != nil {
+		log.Fatalf("Proxy failed: %v\n", err)
+	}
+}
+
+// shutdownOnSignal stops the proxy gracefully on SIGINT or SIGTERM, waiting
+// up to shutdownTimeout for requests in flight before cancelling the context
+// Run was given
+func shutdownOnSignal(shutdownTimeout time.Duration, proxy *healthmonitor.Proxy, cancel context.CancelFunc) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("Received %v, shutting down\n", sig)
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := proxy.Shutdown(ctx); err != nil {
+		log.Printf("Could not shut down gracefully: %v\n", err)
+	}
+	cancel()
+}
 
-	go healthmonitor.MetricsServer(config.Proxy.MetricsPort)
+// reloadConfig re-parses the configuration file on SIGHUP, and whenever its
+// modification time changes if watchInterval is non-zero. Frontends are
+// matched by name, adding or removing them requires a restart
+func reloadConfig(configLocation string, watchInterval time.Duration, proxy *healthmonitor.Proxy) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	// we can launch the health checks before starting the proxy server
-	for id := range config.Backend {
-		go healthMonitor.ConfirmHealth(uint16(id))
+	var tick <-chan time.Time
+	if watchInterval > 0 {
+		tick = time.NewTicker(watchInterval).C
 	}
+	lastModTime := modTime(configLocation)
 
-	// Main application loop
 	for {
-		err := proxy.Start()
-		if err != nil {
-			log.Fatalf("Could not start proxy: %v\n", err)
-			panic(err)
+		select {
+		case <-hup:
+		case <-tick:
+			mtime := modTime(configLocation)
+			if mtime.Equal(lastModTime) {
+				continue
+			}
+			lastModTime = mtime
 		}
 
-		for healthMonitor.IsUnhealthy() || proxy.IsInShutdown() {
-			time.Sleep(config.Proxy.RecoverySleepTime)
+		config, err := healthmonitor.ParseConfig(configLocation)
+		if err != nil {
+			log.Printf("Could not reload config: %v\n", err)
+			continue
 		}
+		proxy.Reload(&config)
+		log.Println("Reloaded config")
+	}
+}
+
+func modTime(configLocation string) time.Time {
+	info, err := os.Stat(configLocation)
+	if err != nil {
+		return time.Time{}
 	}
+	return info.ModTime()
 }
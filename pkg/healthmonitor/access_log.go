@@ -0,0 +1,462 @@
+package healthmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogJSON   = "json"
+	AccessLogLogfmt = "logfmt"
+)
+
+// Access log outputs
+const (
+	AccessLogStdout = "stdout"
+	AccessLogFile   = "file"
+	AccessLogSyslog = "syslog"
+)
+
+const (
+	defaultAccessLogMaxSize    = 100 << 20
+	defaultAccessLogMaxBackups = 5
+	defaultAccessLogSyslogTag  = "tcp-mux-proxy"
+)
+
+// accessLogFields are the fields an access log entry can have, in the order
+// they are written
+var accessLogFields = []string{
+	"time", "server", "client", "method", "host", "path", "status", "bytes_in", "bytes_out",
+	"pool", "backend", "upstream_latency", "latency", "retries", "request_id",
+}
+
+// AccessLogConfig writes a line per request in http mode to Output, which is
+// stdout, a file rotated once it reaches MaxSize bytes with MaxBackups old
+// files kept, or syslog at SyslogAddress over SyslogNetwork, the local syslog
+// daemon if empty. Only SampleRate of the requests are logged, and Fields
+// limits the fields of a line, all of them by default. Latencies are in
+// seconds, the upstream one is the time the backends took to send their
+// response headers
+type AccessLogConfig struct {
+	Output        string   `yaml:"output"`
+	Format        string   `yaml:"format"`
+	Path          string   `yaml:"path"`
+	MaxSize       int64    `yaml:"max_size"`
+	MaxBackups    int      `yaml:"max_backups"`
+	SyslogNetwork string   `yaml:"syslog_network"`
+	SyslogAddress string   `yaml:"syslog_address"`
+	SyslogTag     string   `yaml:"syslog_tag"`
+	SampleRate    float64  `yaml:"sample_rate"`
+	Fields        []string `yaml:"fields"`
+}
+
+func (config AccessLogConfig) enabled() bool {
+	return config.Output != ""
+}
+
+func (config *AccessLogConfig) setDefaults() {
+	if config.Format == "" {
+		config.Format = AccessLogJSON
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultAccessLogMaxSize
+	}
+	if config.MaxBackups <= 0 {
+		config.MaxBackups = defaultAccessLogMaxBackups
+	}
+	if config.SyslogTag == "" {
+		config.SyslogTag = defaultAccessLogSyslogTag
+	}
+	if config.SampleRate <= 0 {
+		config.SampleRate = 1
+	}
+	if len(config.Fields) == 0 {
+		config.Fields = accessLogFields
+	}
+}
+
+func (config AccessLogConfig) validate() error {
+	switch config.Output {
+	case "", AccessLogStdout, AccessLogSyslog:
+	case AccessLogFile:
+		if config.Path == "" {
+			return fmt.Errorf("The file output needs a path")
+		}
+	default:
+		return fmt.Errorf("Invalid output: %q", config.Output)
+	}
+	if config.Format != AccessLogJSON && config.Format != AccessLogLogfmt {
+		return fmt.Errorf("Invalid format: %q", config.Format)
+	}
+	if config.SampleRate > 1 {
+		return fmt.Errorf("Invalid sample_rate: %v", config.SampleRate)
+	}
+	for _, field := range config.Fields {
+		if !containsString(accessLogFields, field) {
+			return fmt.Errorf("Unknown field: %q", field)
+		}
+	}
+	return nil
+}
+
+// sameSink returns true if both configs write to the same place
+func (config AccessLogConfig) sameSink(other AccessLogConfig) bool {
+	return config.Output == other.Output && config.Path == other.Path &&
+		config.MaxSize == other.MaxSize && config.MaxBackups == other.MaxBackups &&
+		config.SyslogNetwork == other.SyslogNetwork && config.SyslogAddress == other.SyslogAddress &&
+		config.SyslogTag == other.SyslogTag
+}
+
+// accessLogger is the access log of a proxy handler
+type accessLogger struct {
+	config AccessLogConfig
+	fields map[string]bool
+	sink   *accessLogSink
+}
+
+// setAccessLogConfig swaps in a new access log, keeping the sink of the
+// current one if it did not change. If the new sink can not be opened the
+// current access log is kept as is
+func (ph *proxyHandler) setAccessLogConfig(config AccessLogConfig) {
+	config.setDefaults()
+	old, _ := ph.accessLog.Load().(*accessLogger)
+	if !config.enabled() {
+		ph.accessLog.Store((*accessLogger)(nil))
+		if old != nil {
+			old.sink.Close()
+		}
+		return
+	}
+
+	logger := &accessLogger{config: config, fields: make(map[string]bool, len(config.Fields))}
+	for _, field := range config.Fields {
+		logger.fields[field] = true
+	}
+	if old != nil && old.config.sameSink(config) {
+		logger.sink = old.sink
+		ph.accessLog.Store(logger)
+		return
+	}
+	sink, err := openAccessLogSink(config)
+	if err != nil {
+		if old != nil {
+			log.Printf("Could not open access log, keeping the previous one: %v\n", err)
+			return
+		}
+		log.Printf("Could not open access log, access logging is disabled: %v\n", err)
+		ph.accessLog.Store((*accessLogger)(nil))
+		return
+	}
+	logger.sink = sink
+	ph.accessLog.Store(logger)
+	if old != nil {
+		old.sink.Close()
+	}
+}
+
+func (ph *proxyHandler) getAccessLog() *accessLogger {
+	logger, _ := ph.accessLog.Load().(*accessLogger)
+	return logger
+}
+
+// sample decides whether a request is logged
+func (logger *accessLogger) sample() bool {
+	return logger.config.SampleRate >= 1 || rand.Float64() < logger.config.SampleRate
+}
+
+// accessLogEntry is what is known about a request once it has been served
+type accessLogEntry struct {
+	start    time.Time
+	server   string
+	request  *http.Request
+	info     *requestInfo
+	bytesIn  int64
+	response *responseRecorder
+}
+
+func (logger *accessLogger) log(entry accessLogEntry) {
+	var line bytes.Buffer
+	write := func(field string, value interface{}) {
+		if !logger.fields[field] {
+			return
+		}
+		if logger.config.Format == AccessLogJSON {
+			if line.Len() == 0 {
+				line.WriteByte('{')
+			} else {
+				line.WriteByte(',')
+			}
+			name, _ := json.Marshal(field)
+			encoded, _ := json.Marshal(value)
+			line.Write(name)
+			line.WriteByte(':')
+			line.Write(encoded)
+			return
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(field)
+		line.WriteByte('=')
+		line.WriteString(logfmtValue(value))
+	}
+
+	r, info := entry.request, entry.info
+	backend, pool, retries := "", "", 0
+	if info.route != nil && info.route.pool != nil {
+		pool = info.route.pool.name
+	}
+	if info.attempts > 0 {
+		backend = info.backend
+		retries = info.attempts - 1
+	}
+	write("time", entry.start.UTC().Format(time.RFC3339Nano))
+	write("server", entry.server)
+	write("client", r.RemoteAddr)
+	write("method", r.Method)
+	write("host", r.Host)
+	write("path", r.URL.Path)
+	write("status", entry.response.statusCode())
+	write("bytes_in", entry.bytesIn)
+	write("bytes_out", entry.response.written)
+	write("pool", pool)
+	write("backend", backend)
+	write("upstream_latency", info.upstreamLatency.Seconds())
+	write("latency", time.Since(entry.start).Seconds())
+	write("retries", retries)
+	write("request_id", info.requestID)
+	if logger.config.Format == AccessLogJSON {
+		line.WriteByte('}')
+	}
+	line.WriteByte('\n')
+	logger.sink.Write(line.Bytes())
+}
+
+// logfmtValue formats a value for logfmt, quoting strings that need it
+func logfmtValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		if v == "" || strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < ' ' }) >= 0 {
+			return strconv.Quote(v)
+		}
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// responseRecorder records the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(p []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(p)
+	recorder.written += int64(n)
+	return n, err
+}
+
+func (recorder *responseRecorder) statusCode() int {
+	if recorder.status == 0 {
+		return http.StatusOK
+	}
+	return recorder.status
+}
+
+// Flush lets streamed responses through
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the reverse proxy take over connections for protocol upgrades
+func (recorder *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Response writer does not support hijacking")
+	}
+	recorder.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// countingBody counts the bytes read off a request body
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.read += int64(n)
+	return n, err
+}
+
+// accessLogSink serializes the writes to an access log output. Sinks are
+// shared by the frontends that write to the same place, and closed once the
+// last of them lets go
+type accessLogSink struct {
+	key   string
+	refs  int
+	mu    sync.Mutex
+	w     io.Writer
+	close func() error
+}
+
+var (
+	accessLogSinksMu sync.Mutex
+	accessLogSinks   = make(map[string]*accessLogSink)
+)
+
+func (sink *accessLogSink) Write(p []byte) (int, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.w == nil {
+		return 0, os.ErrClosed
+	}
+	return sink.w.Write(p)
+}
+
+func (sink *accessLogSink) Close() error {
+	accessLogSinksMu.Lock()
+	sink.refs--
+	last := sink.refs == 0
+	if last {
+		delete(accessLogSinks, sink.key)
+	}
+	accessLogSinksMu.Unlock()
+	if !last {
+		return nil
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.w = nil
+	return sink.close()
+}
+
+func openAccessLogSink(config AccessLogConfig) (*accessLogSink, error) {
+	key := config.Output
+	switch config.Output {
+	case AccessLogFile:
+		// a reload changing the rotation gets a new sink with the new settings
+		key += ":" + config.Path + ":" + strconv.FormatInt(config.MaxSize, 10) + ":" + strconv.Itoa(config.MaxBackups)
+	case AccessLogSyslog:
+		key += ":" + config.SyslogNetwork + ":" + config.SyslogAddress + ":" + config.SyslogTag
+	}
+	accessLogSinksMu.Lock()
+	defer accessLogSinksMu.Unlock()
+	if sink, ok := accessLogSinks[key]; ok {
+		sink.refs++
+		return sink, nil
+	}
+
+	sink := &accessLogSink{key: key, refs: 1, w: os.Stdout, close: func() error { return nil }}
+	switch config.Output {
+	case AccessLogFile:
+		file, err := openRotatingFile(config.Path, config.MaxSize, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink.w, sink.close = file, file.Close
+	case AccessLogSyslog:
+		writer, err := syslog.Dial(config.SyslogNetwork, config.SyslogAddress, syslog.LOG_INFO|syslog.LOG_DAEMON, config.SyslogTag)
+		if err != nil {
+			return nil, err
+		}
+		sink.w, sink.close = writer, writer.Close
+	}
+	accessLogSinks[key] = sink
+	return sink, nil
+}
+
+// rotatingFile is a file that is renamed to path.1 once it reaches maxSize,
+// shifting the older files up to path.maxBackups
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// Write is called with the lock of the sink held
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			log.Printf("Could not rotate access log %v: %v\n", rf.path, err)
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate keeps writing to the current file if it can not be renamed
+func (rf *rotatingFile) rotate() error {
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	old := rf.file
+	if err := rf.open(); err != nil {
+		// the renamed file is still open
+		return err
+	}
+	return old.Close()
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.file.Close()
+}
@@ -0,0 +1,149 @@
+package healthmonitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	dir, err := ioutil.TempDir("", "access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "access_log_test"
+	config.Proxy.Headers.RequestID = HeaderGenerate
+	config.Proxy.AccessLog = AccessLogConfig{Output: AccessLogFile, Path: path}
+	config.Backend = []BackendPort{{Name: "server_1", URL: downstreamURL}}
+	proxy := NewProxyServer(&config)
+	defer proxy.ph.setAccessLogConfig(AccessLogConfig{})
+
+	serve := func() string {
+		request := httptest.NewRequest(http.MethodPost, "http://example.com/items?page=1", strings.NewReader("payload"))
+		proxy.ph.ServeHTTP(httptest.NewRecorder(), request)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		return lines[len(lines)-1]
+	}
+
+	var entry map[string]interface{}
+	line := serve()
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("Expected a json line, got %q: %v", line, err)
+	}
+	for field, value := range map[string]interface{}{
+		"server":    "access_log_test",
+		"client":    "192.0.2.1:1234",
+		"method":    http.MethodPost,
+		"host":      "example.com",
+		"path":      "/items",
+		"status":    float64(http.StatusCreated),
+		"bytes_in":  float64(len("payload")),
+		"bytes_out": float64(len("created")),
+		"pool":      DefaultPool,
+		"backend":   "server_1",
+		"retries":   float64(0),
+	} {
+		if entry[field] != value {
+			t.Errorf("Expected %v to be %v, got %v", field, value, entry[field])
+		}
+	}
+	if id, _ := entry["request_id"].(string); len(id) != 36 {
+		t.Errorf("Expected the request id to be logged, got %v", entry["request_id"])
+	}
+	if latency, _ := entry["latency"].(float64); latency <= 0 || latency < entry["upstream_latency"].(float64) {
+		t.Errorf("Expected the latency to cover the upstream latency, got %v and %v", entry["latency"], entry["upstream_latency"])
+	}
+
+	// a reload keeps the file open and changes the format
+	proxy.ph.setAccessLogConfig(AccessLogConfig{Output: AccessLogFile, Path: path, Format: AccessLogLogfmt, Fields: []string{"method", "path", "status", "backend"}})
+	if line := serve(); line != "method=POST path=/items status=201 backend=server_1" {
+		t.Errorf("Expected a logfmt line with the configured fields, got %q", line)
+	}
+
+	// requests that are not proxied are logged without a backend
+	proxy.ph.setAccessLogConfig(AccessLogConfig{Output: AccessLogFile, Path: path, Format: AccessLogLogfmt, Fields: []string{"status", "backend"}})
+	proxy.ph.setServerConfig(ServerConfig{MaxBodySize: 1})
+	if line := serve(); line != `status=413 backend=""` {
+		t.Errorf("Expected the rejected request to be logged, got %q", line)
+	}
+
+	// a reload changing the rotation of the file reopens it with the new one
+	proxy.ph.setAccessLogConfig(AccessLogConfig{Output: AccessLogFile, Path: path, MaxBackups: 2, Format: AccessLogLogfmt, Fields: []string{"status", "backend"}})
+	if file, ok := proxy.ph.getAccessLog().sink.w.(*rotatingFile); !ok || file.maxBackups != 2 {
+		t.Errorf("Expected the file to be reopened with 2 backups, got %+v", proxy.ph.getAccessLog().sink.w)
+	}
+
+	// a reload to a sink that can not be opened keeps the current one
+	proxy.ph.setAccessLogConfig(AccessLogConfig{Output: AccessLogFile, Path: filepath.Join(dir, "missing", "access.log")})
+	if line := serve(); line != `status=413 backend=""` {
+		t.Errorf("Expected the previous access log to be kept, got %q", line)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	file, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		file.Write([]byte("line " + strconv.Itoa(i) + "\n"))
+	}
+	file.Close()
+
+	for name, expected := range map[string]string{"access.log": "line 4\n", "access.log.1": "line 3\n", "access.log.2": "line 2\n"} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(contents) != expected {
+			t.Errorf("Expected %v to contain %q, got %q: %v", name, expected, contents, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept, got %v", err)
+	}
+}
+
+func TestLogfmtValue(t *testing.T) {
+	for value, expected := range map[interface{}]string{
+		"plain":       "plain",
+		"":            `""`,
+		"with space":  `"with space"`,
+		`a="b"`:       `"a=\"b\""`,
+		"line\nbreak": `"line\nbreak"`,
+		0.25:          "0.25",
+		413:           "413",
+	} {
+		if actual := logfmtValue(value); actual != expected {
+			t.Errorf("Expected %v to be formatted as %v, got %v", value, expected, actual)
+		}
+	}
+}
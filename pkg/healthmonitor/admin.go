@@ -0,0 +1,361 @@
+package healthmonitor
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/wish/tcp-mux-proxy/pkg/loadbalancer"
+)
+
+// AdminConfig enables the admin API, which is served under /admin/ on Bind,
+// or on the metrics port if Bind is empty. Every request must carry Token,
+// or the contents of TokenFile, as a bearer token. Changes to it require a
+// restart
+type AdminConfig struct {
+	Bind      string `yaml:"bind"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// Enabled returns true if a token is configured
+func (config AdminConfig) Enabled() bool {
+	return config.Token != "" || config.TokenFile != ""
+}
+
+func (config AdminConfig) validate() error {
+	if !config.Enabled() {
+		if config.Bind != "" {
+			return fmt.Errorf("The admin API needs a token")
+		}
+		return nil
+	}
+	if config.Token != "" && config.TokenFile != "" {
+		return fmt.Errorf("Only one of token and token_file can be set")
+	}
+	_, err := config.token()
+	return err
+}
+
+func (config AdminConfig) token() (string, error) {
+	if config.TokenFile == "" {
+		return config.Token, nil
+	}
+	contents, err := ioutil.ReadFile(config.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("Token file %v is empty", config.TokenFile)
+	}
+	return token, nil
+}
+
+// BackendStatus is the state of a backend as the admin API reports it
+type BackendStatus struct {
+	Frontend          string `json:"frontend"`
+	Name              string `json:"name"`
+	Pool              string `json:"pool"`
+	Address           string `json:"address"`
+	State             string `json:"state"`
+	Ejected           bool   `json:"ejected"`
+	Forced            bool   `json:"forced"`
+	InRotation        bool   `json:"in_rotation"`
+	ActiveConnections int64  `json:"active_connections"`
+	Weight            uint32 `json:"weight"`
+	// LastCheck is nil until the first health check has finished
+	LastCheck            *time.Time `json:"last_check"`
+	LastError            string     `json:"last_error,omitempty"`
+	ConsecutiveFailures  int        `json:"consecutive_failures"`
+	ConsecutiveSuccesses int        `json:"consecutive_successes"`
+}
+
+// Backends returns the status of every backend, ordered by name
+func (hm *HealthMonitor) Backends() []BackendStatus {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	statuses := make([]BackendStatus, 0, len(hm.checks))
+	for _, check := range hm.checks {
+		statuses = append(statuses, hm.backendStatus(check))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Backend returns the status of the named backend
+func (hm *HealthMonitor) Backend(name string) (BackendStatus, bool) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	check, ok := hm.checks[name]
+	if !ok {
+		return BackendStatus{}, false
+	}
+	return hm.backendStatus(check), true
+}
+
+// backendStatus must be called with hm.mu held
+func (hm *HealthMonitor) backendStatus(check *backendCheck) BackendStatus {
+	status := BackendStatus{
+		Frontend:          hm.serverLabel["server"],
+		Name:              check.backend.Name,
+		Pool:              check.backend.poolName(),
+		Address:           check.backend.Address,
+		State:             check.state.String(),
+		Ejected:           check.ejected,
+		Forced:            check.forced,
+		InRotation:        check.inRotation(),
+		ActiveConnections: hm.proxy.ph.activeConnections(check.backend.Name),
+		Weight:            hm.proxy.ph.backendWeight(check.backend),
+	}
+	if !check.lastCheck.IsZero() {
+		lastCheck := check.lastCheck
+		status.LastCheck = &lastCheck
+		status.LastError = check.lastError
+		status.ConsecutiveFailures = check.failures
+		status.ConsecutiveSuccesses = check.successes
+	}
+	return status
+}
+
+// SetHealthy forces the named backend healthy or unhealthy, taking it out of
+// drain. Its health checks carry on but leave the state alone until
+// ResumeHealthChecks, SetDraining or a reload clears it
+func (hm *HealthMonitor) SetHealthy(name string, healthy bool) error {
+	hm.mu.Lock()
+	check, ok := hm.checks[name]
+	if !ok {
+		hm.mu.Unlock()
+		return fmt.Errorf("Unknown backend: %q", name)
+	}
+	next := StateUnhealthy
+	if healthy {
+		next = StateHealthy
+	}
+	check.successes, check.failures = 0, 0
+	check.forced = true
+	transition := hm.setState(check, next)
+	hm.mu.Unlock()
+
+	log.Printf("Backend %v was marked %v\n", name, next)
+	hm.applyTransition(transition)
+	return nil
+}
+
+// ResumeHealthChecks hands the state of the named backend back to its health
+// checks after SetHealthy, which move it once they reach Rise or Fall
+func (hm *HealthMonitor) ResumeHealthChecks(name string) error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	check, ok := hm.checks[name]
+	if !ok {
+		return fmt.Errorf("Unknown backend: %q", name)
+	}
+	if check.forced {
+		check.forced = false
+		check.successes, check.failures = 0, 0
+		log.Printf("Backend %v is back under its health checks\n", name)
+	}
+	return nil
+}
+
+// CheckNow runs the health check of the named backend without waiting for
+// its interval
+func (hm *HealthMonitor) CheckNow(name string) error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	check, ok := hm.checks[name]
+	if !ok {
+		return fmt.Errorf("Unknown backend: %q", name)
+	}
+	select {
+	case check.trigger <- struct{}{}:
+	default:
+		// a check is already due
+	}
+	return nil
+}
+
+// SetWeight changes the weight of the named backend until a reload changes
+// its configured weight
+func (hm *HealthMonitor) SetWeight(name string, weight uint32) error {
+	if err := hm.proxy.SetWeight(name, weight); err != nil {
+		return err
+	}
+	hm.metrics.weight.With(hm.backendLabels(name)).Set(float64(weight))
+	return nil
+}
+
+// trackConnection counts a connection to a backend until the returned func
+// is called
+func (ph *proxyHandler) trackConnection(name string) func() {
+	counter, ok := ph.activeConns.Load(name)
+	if !ok {
+		counter, _ = ph.activeConns.LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(counter.(*int64), 1)
+	return func() { atomic.AddInt64(counter.(*int64), -1) }
+}
+
+func (ph *proxyHandler) activeConnections(name string) int64 {
+	if counter, ok := ph.activeConns.Load(name); ok {
+		return atomic.LoadInt64(counter.(*int64))
+	}
+	return 0
+}
+
+// backendWeight returns the weight the load balancer gives a backend, or the
+// configured one if it does not use weights
+func (ph *proxyHandler) backendWeight(backend BackendPort) uint32 {
+	pool, ok := ph.getRoutes().byBackend[backend.Name]
+	if !ok {
+		return backend.Weight
+	}
+	if lb, ok := pool.lb.(loadbalancer.WeightedLoadBalancer); ok {
+		return lb.Weight(pool.ids[backend.Name])
+	}
+	return backend.Weight
+}
+
+// adminHandler serves the admin API for the health monitors of every
+// frontend by name:
+//
+//	GET  /admin/backends                             status of every backend
+//	GET  /admin/backends/{frontend}/{backend}        status of a backend
+//	POST /admin/backends/{frontend}/{backend}/drain  take it out of rotation
+//	POST /admin/backends/{frontend}/{backend}/undrain
+//	POST /admin/backends/{frontend}/{backend}/healthy
+//	POST /admin/backends/{frontend}/{backend}/unhealthy
+//	POST /admin/backends/{frontend}/{backend}/resume  undo healthy or unhealthy
+//	POST /admin/backends/{frontend}/{backend}/check  run its health check now
+//	PUT  /admin/backends/{frontend}/{backend}/weight with {"weight": n}
+type adminHandler struct {
+	token    string
+	monitors map[string]*HealthMonitor
+}
+
+// NewAdminHandler returns the handler of the admin API for the health
+// monitors of the frontends by name
+func NewAdminHandler(config AdminConfig, monitors map[string]*HealthMonitor) (http.Handler, error) {
+	token, err := config.token()
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("The admin API needs a token")
+	}
+	return &adminHandler{token: token, monitors: monitors}, nil
+}
+
+func (ah *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authorization := r.Header.Get("Authorization")
+	given := strings.TrimPrefix(authorization, "Bearer ")
+	if given == authorization || subtle.ConstantTimeCompare([]byte(given), []byte(ah.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid or missing token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+	if parts[0] != "backends" || len(parts) == 2 || len(parts) > 4 {
+		writeJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		statuses := []BackendStatus{}
+		for _, name := range ah.frontendNames() {
+			statuses = append(statuses, ah.monitors[name].Backends()...)
+		}
+		writeJSON(w, http.StatusOK, statuses)
+		return
+	}
+
+	hm, ok := ah.monitors[parts[1]]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Unknown frontend: %q", parts[1]))
+		return
+	}
+	name := parts[2]
+	if _, ok := hm.Backend(name); !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Unknown backend: %q", name))
+		return
+	}
+	action := ""
+	if len(parts) == 4 {
+		action = parts[3]
+	}
+	method := http.MethodPost
+	switch action {
+	case "":
+		method = http.MethodGet
+	case "weight":
+		method = http.MethodPut
+	}
+	if r.Method != method {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var err error
+	code := http.StatusOK
+	switch action {
+	case "":
+	case "drain", "undrain":
+		err = hm.SetDraining(name, action == "drain")
+	case "healthy", "unhealthy":
+		err = hm.SetHealthy(name, action == "healthy")
+	case "resume":
+		err = hm.ResumeHealthChecks(name)
+	case "check":
+		err = hm.CheckNow(name)
+		code = http.StatusAccepted
+	case "weight":
+		var body struct {
+			Weight *uint32 `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Weight == nil {
+			writeJSONError(w, http.StatusBadRequest, "Expected a body like {\"weight\": 1}")
+			return
+		}
+		err = hm.SetWeight(name, *body.Weight)
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Unknown action: %q", action))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	status, _ := hm.Backend(name)
+	writeJSON(w, code, status)
+}
+
+func (ah *adminHandler) frontendNames() []string {
+	names := make([]string, 0, len(ah.monitors))
+	for name := range ah.monitors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
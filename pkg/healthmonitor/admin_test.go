@@ -0,0 +1,167 @@
+package healthmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingChecker is always healthy and counts its checks
+type countingChecker struct {
+	checks int32
+}
+
+func (checker *countingChecker) Check(ctx context.Context) error {
+	atomic.AddInt32(&checker.checks, 1)
+	return nil
+}
+
+func TestAdminAPI(t *testing.T) {
+	checker := &countingChecker{}
+	var config Config
+	config.Proxy.Name = "admin_test"
+	for _, name := range []string{"admin_1", "admin_2"} {
+		config.Backend = append(config.Backend, BackendPort{
+			Name:                name,
+			Address:             "localhost:3000",
+			URL:                 &url.URL{Scheme: "http", Host: "localhost:3000"},
+			HealthCheckInterval: time.Hour,
+			Rise:                1,
+			Fall:                1,
+			Weight:              1,
+			HealthCheck:         HealthCheckConfig{Checker: checker},
+		})
+	}
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	healthMonitor.Start(context.Background())
+	defer healthMonitor.Stop()
+	for i := 0; i < 100 && atomic.LoadInt32(&checker.checks) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	handler, err := NewAdminHandler(AdminConfig{Token: "secret"}, map[string]*HealthMonitor{"admin_test": healthMonitor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, path, token, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	backend := func(recorder *httptest.ResponseRecorder) BackendStatus {
+		var status BackendStatus
+		if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if code := call(http.MethodGet, "/admin/backends", token, "").Code; code != http.StatusUnauthorized {
+			t.Errorf("Expected token %q to be refused, got %v", token, code)
+		}
+	}
+
+	var statuses []BackendStatus
+	json.NewDecoder(call(http.MethodGet, "/admin/backends", "secret", "").Body).Decode(&statuses)
+	if len(statuses) != 2 || statuses[0].Name != "admin_1" || statuses[0].State != "healthy" || !statuses[0].InRotation {
+		t.Errorf("Expected both backends to be listed healthy, got %+v", statuses)
+	}
+
+	prefix := "/admin/backends/admin_test/admin_1"
+	for _, step := range []struct {
+		action string
+		state  string
+	}{
+		{"drain", "draining"},
+		{"undrain", "unknown"},
+		{"unhealthy", "unhealthy"},
+		{"healthy", "healthy"},
+	} {
+		recorder := call(http.MethodPost, prefix+"/"+step.action, "secret", "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected %v to succeed, got %v: %v", step.action, recorder.Code, recorder.Body)
+		}
+		if status := backend(recorder); status.State != step.state {
+			t.Errorf("Expected %v to leave the backend %v, got %v", step.action, step.state, status.State)
+		}
+		if step.action == "drain" && atomic.LoadUint32(&healthMonitor.numUnhealthy) != 1 {
+			t.Errorf("Expected the drained backend to count as unhealthy")
+		}
+	}
+
+	recorder := call(http.MethodPut, prefix+"/weight", "secret", `{"weight": 5}`)
+	if status := backend(recorder); recorder.Code != http.StatusOK || status.Weight != 5 {
+		t.Errorf("Expected the weight to change to 5, got %v %+v", recorder.Code, status)
+	}
+
+	// a forced state outlasts passing checks until health checks are resumed
+	if status := backend(call(http.MethodPost, prefix+"/unhealthy", "secret", "")); !status.Forced {
+		t.Errorf("Expected unhealthy to force the state, got %+v", status)
+	}
+	checks := atomic.LoadInt32(&checker.checks)
+	if code := call(http.MethodPost, prefix+"/check", "secret", "").Code; code != http.StatusAccepted {
+		t.Errorf("Expected the check to be accepted, got %v", code)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&checker.checks) == checks; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&checker.checks) == checks {
+		t.Error("Expected the health check to run right away")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if status := backend(call(http.MethodGet, prefix, "secret", "")); status.State != "unhealthy" {
+		t.Errorf("Expected a passing check to leave the forced state alone, got %v", status.State)
+	}
+
+	if status := backend(call(http.MethodPost, prefix+"/resume", "secret", "")); status.Forced || status.State != "unhealthy" {
+		t.Errorf("Expected resume to clear the override only, got %+v", status)
+	}
+	call(http.MethodPost, prefix+"/check", "secret", "")
+	state := ""
+	for i := 0; i < 100 && state != "healthy"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		state = backend(call(http.MethodGet, prefix, "secret", "")).State
+	}
+	if state != "healthy" {
+		t.Errorf("Expected the resumed health check to mark the backend healthy, got %v", state)
+	}
+
+	done := proxy.ph.trackConnection("admin_1")
+	if status := backend(call(http.MethodGet, prefix, "secret", "")); status.ActiveConnections != 1 {
+		t.Errorf("Expected 1 active connection, got %v", status.ActiveConnections)
+	}
+	done()
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "/admin/backends/missing/admin_1", "", http.StatusNotFound},
+		{http.MethodGet, "/admin/backends/admin_test/missing", "", http.StatusNotFound},
+		{http.MethodPost, prefix + "/restart", "", http.StatusNotFound},
+		{http.MethodGet, prefix + "/drain", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/backends", "", http.StatusMethodNotAllowed},
+		{http.MethodPut, prefix + "/weight", `{"weight": "heavy"}`, http.StatusBadRequest},
+		{http.MethodPut, prefix + "/weight", `{}`, http.StatusBadRequest},
+		{http.MethodPut, prefix + "/weight", `{"weight": 100000}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/backends/admin_test/missing/resume", "", http.StatusNotFound},
+	} {
+		if code := call(test.method, test.path, "secret", test.body).Code; code != test.code {
+			t.Errorf("Expected %v %v to answer %v, got %v", test.method, test.path, test.code, code)
+		}
+	}
+}
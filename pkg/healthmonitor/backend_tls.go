@@ -0,0 +1,57 @@
+package healthmonitor
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// BackendTLSConfig configures TLS from the proxy to a backend, for both
+// proxied traffic and health checks. It is enabled by an https host as well.
+// CAFile replaces the system roots, CertFile and KeyFile are the client
+// certificate for mutual TLS, and ServerName overrides the name the backend
+// certificate is verified against. InsecureSkipVerify is meant for staging
+type BackendTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// clientTLSConfig builds the tls.Config used to connect to a backend, it is
+// nil for backends reached in plaintext
+func (backend BackendPort) clientTLSConfig() (*tls.Config, error) {
+	config := backend.TLS
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if tlsConfig.ServerName == "" {
+		if backend.URL != nil && backend.URL.Hostname() != "" {
+			tlsConfig.ServerName = backend.URL.Hostname()
+		} else if host, _, err := net.SplitHostPort(backend.Address); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -1,27 +1,66 @@
 package healthmonitor
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"path/filepath"
 	"strconv"
 	"time"
 
+	"github.com/wish/tcp-mux-proxy/pkg/loadbalancer"
 	"gopkg.in/yaml.v2"
 )
 
+// Proxy modes supported by a frontend
+const (
+	// ModeHTTP reverse proxies HTTP requests to the backends
+	ModeHTTP = "http"
+	// ModeTCP splices raw TCP connections to the backends
+	ModeTCP = "tcp"
+)
+
 // Config contains the options you can set for the proxy
 type Config struct {
 	Proxy struct {
-		Bind              string        `yaml:"bind"`
-		MetricsPort       string        `yaml:"metrics_server_port"`
-		MaxConn           int           `yaml:"max_conn"`
-		MinAlive          int           `yaml:"min_alive"`
+		Bind             string                 `yaml:"bind"`
+		Mode             string                 `yaml:"mode"`
+		LBAlgorithm      string                 `yaml:"lb_algorithm"`
+		HashKey          HashKeyConfig          `yaml:"hash_key"`
+		OutlierDetection OutlierDetectionConfig `yaml:"outlier_detection"`
+		ShutdownMode     string                 `yaml:"shutdown_mode"`
+		Drain            DrainConfig            `yaml:"drain"`
+		Retry            RetryConfig            `yaml:"retry"`
+		TLS              TLSConfig              `yaml:"tls"`
+		Transport        TransportConfig        `yaml:"transport"`
+		Server           ServerConfig           `yaml:"server"`
+		ProxyProtocol    ProxyProtocolConfig    `yaml:"proxy_protocol"`
+		Headers          HeadersConfig          `yaml:"headers"`
+		AccessLog        AccessLogConfig        `yaml:"access_log"`
+		Queue            QueueConfig            `yaml:"queue"`
+		MetricsPort      string                 `yaml:"metrics_server_port"`
+		MaxConn          int                    `yaml:"max_conn"`
+		MinAlive         int                    `yaml:"min_alive"`
+		// RecoverySleepTime is how long a frontend waits to be started
+		// again once its health monitor brings it back up
 		RecoverySleepTime time.Duration `yaml:"recovery_sleep_time"`
 		Name              string        `yaml:"name"`
 	} `yaml:"proxy"`
 	Backend []BackendPort `yaml:"backend"`
+	Pools   []PoolConfig  `yaml:"pools"`
+	Routes  []RouteConfig `yaml:"routes"`
+	// Admin and Metrics are read from the top level only
+	Admin   AdminConfig   `yaml:"admin"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	// Version identifies the contents of the file the config was parsed from
+	Version string `yaml:"-"`
+	// Frontends are parsed from the frontends section, which lists more
+	// proxies to run in the same process. Each one takes the settings it
+	// does not override from the top level
+	Frontends []Config `yaml:"-"`
 }
 
 // BackendPort contains the options you can set for a backend server
@@ -31,7 +70,66 @@ type BackendPort struct {
 	Port                int           `yaml:"port"`
 	HealthCheckEndpoint string        `yaml:"health_check_endpoint"`
 	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
-	URL                 *url.URL
+	// Rise is the number of consecutive successful checks for an unhealthy
+	// backend to become healthy, Fall the number of consecutive failed checks
+	// for a healthy one to become unhealthy. Both default to 1
+	Rise        int               `yaml:"rise"`
+	Fall        int               `yaml:"fall"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	// Pool is the name of the pool the backend belongs to, backends without
+	// one are in the default pool
+	Pool string `yaml:"pool"`
+	// ProxyProtocol is the version of the PROXY protocol header sent to the
+	// backend ahead of each connection, tcp mode only
+	ProxyProtocol string `yaml:"proxy_protocol"`
+	// Weight is the share of traffic the backend gets relative to the other
+	// backends, it defaults to 1 and applies to the p2c and ring_hash
+	// algorithms. An explicit weight of 0 keeps new traffic away from the
+	// backend, unless every backend of the pool has weight 0 and they share
+	// the traffic evenly. It can be at most 1000
+	Weight    uint32           `yaml:"weight"`
+	TLS       BackendTLSConfig `yaml:"tls"`
+	Transport TransportConfig  `yaml:"transport"`
+	URL       *url.URL
+	// Address is the host:port used to dial the backend in tcp mode
+	Address string
+}
+
+// UnmarshalYAML defaults the weight before decoding, so an unset weight can be
+// told from an explicit 0
+func (backend *BackendPort) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain BackendPort
+	decoded := plain{Weight: 1}
+	if err := unmarshal(&decoded); err != nil {
+		return err
+	}
+	*backend = BackendPort(decoded)
+	return nil
+}
+
+// HealthCheckConfig selects and configures the health check of a backend.
+// The http check requests HealthCheckEndpoint and without expected statuses
+// treats any status below 400 as healthy
+type HealthCheckConfig struct {
+	Type    string        `yaml:"type"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// http options
+	Method         string            `yaml:"method"`
+	Host           string            `yaml:"host"`
+	Headers        map[string]string `yaml:"headers"`
+	ExpectedStatus []int             `yaml:"expected_status"`
+	BodyRegex      string            `yaml:"body_regex"`
+
+	// grpc options, an empty service checks the overall server health
+	Service string `yaml:"service"`
+
+	// exec options, the command is run without a shell
+	Command []string `yaml:"command"`
+
+	// Checker, if set, is used instead of the configured type. This allows
+	// library users to plug in their own health checks
+	Checker HealthChecker `yaml:"-"`
 }
 
 // ParseConfig parses the configuration file
@@ -52,14 +150,224 @@ func ParseConfig(configLocation string) (Config, error) {
 	if err != nil {
 		return Config{}, fmt.Errorf("Invalid yaml file: %v", err)
 	}
+	sum := sha256.Sum256(file)
+	config.Version = hex.EncodeToString(sum[:6])
+	var raw struct {
+		Frontends []yaml.MapSlice `yaml:"frontends"`
+	}
+	if err := yaml.Unmarshal(file, &raw); err != nil {
+		return Config{}, fmt.Errorf("Invalid yaml file: %v", err)
+	}
+
+	// frontends are decoded on top of a fresh decoding of the top level, so
+	// they inherit what the file says without sharing its maps and slices
+	for _, overrides := range raw.Frontends {
+		var frontend Config
+		if err := yaml.Unmarshal(file, &frontend); err != nil {
+			return Config{}, fmt.Errorf("Invalid yaml file: %v", err)
+		}
+		frontend.Version = config.Version
+		out, err := yaml.Marshal(overrides)
+		if err != nil {
+			return Config{}, fmt.Errorf("Invalid frontend: %v", err)
+		}
+		if err := yaml.Unmarshal(out, &frontend); err != nil {
+			return Config{}, fmt.Errorf("Invalid frontend: %v", err)
+		}
+		config.Frontends = append(config.Frontends, frontend)
+	}
+
+	// with frontends the top level only holds what they inherit, so it does
+	// not need backends or a listener of its own
+	if len(config.Frontends) == 0 {
+		if err := config.validate(); err != nil {
+			return Config{}, err
+		}
+	}
+	// the admin API is shared by the frontends
+	if err := config.Admin.validate(); err != nil {
+		return Config{}, fmt.Errorf("Invalid admin config: %v", err)
+	}
+	config.Metrics.setDefaults()
+	if err := config.Metrics.validate(); err != nil {
+		return Config{}, fmt.Errorf("Invalid metrics config: %v", err)
+	}
+	binds := make(map[string]bool, len(config.Frontends))
+	names := make(map[string]bool, len(config.Frontends))
+	accessLogs := make(map[string]AccessLogConfig, len(config.Frontends))
+	for i := range config.Frontends {
+		frontend := &config.Frontends[i]
+		frontend.Metrics = config.Metrics
+		if err := frontend.validate(); err != nil {
+			return Config{}, fmt.Errorf("Invalid frontend %q: %v", frontend.Proxy.Name, err)
+		}
+		if names[frontend.Proxy.Name] {
+			return Config{}, fmt.Errorf("Duplicate frontend name: %q", frontend.Proxy.Name)
+		}
+		names[frontend.Proxy.Name] = true
+		if binds[frontend.Proxy.Bind] {
+			return Config{}, fmt.Errorf("Duplicate frontend bind: %q", frontend.Proxy.Bind)
+		}
+		binds[frontend.Proxy.Bind] = true
+		// frontends logging to the same file share it, so they have to agree
+		// on when it is rotated
+		accessLog := frontend.Proxy.AccessLog
+		if accessLog.Output == AccessLogFile {
+			accessLog.setDefaults()
+			if other, ok := accessLogs[accessLog.Path]; ok && !other.sameSink(accessLog) {
+				return Config{}, fmt.Errorf("Frontend %q rotates the access log %q differently than another frontend", frontend.Proxy.Name, accessLog.Path)
+			}
+			accessLogs[accessLog.Path] = accessLog
+		}
+	}
+	return config, nil
+}
+
+// FrontendConfigs returns the config of every frontend to run, which is the
+// top level config itself unless it lists frontends
+func (config Config) FrontendConfigs() []Config {
+	if len(config.Frontends) == 0 {
+		return []Config{config}
+	}
+	return config.Frontends
+}
+
+// validate checks a config and fills in its defaults
+func (config *Config) validate() error {
+	var err error
+	switch config.Proxy.Mode {
+	case "":
+		config.Proxy.Mode = ModeHTTP
+	case ModeHTTP, ModeTCP:
+	default:
+		return fmt.Errorf("Invalid proxy mode: %q", config.Proxy.Mode)
+	}
 
+	if config.Proxy.LBAlgorithm == "" {
+		config.Proxy.LBAlgorithm = loadbalancer.PowerOfTwo
+	}
+	if _, err := loadbalancer.New(config.Proxy.LBAlgorithm, nil); err != nil {
+		return err
+	}
+	for _, pool := range config.Pools {
+		if pool.LBAlgorithm == "" {
+			continue
+		}
+		if _, err := loadbalancer.New(pool.LBAlgorithm, nil); err != nil {
+			return fmt.Errorf("Invalid lb_algorithm for pool %q: %v", pool.Name, err)
+		}
+	}
+	if err := config.Proxy.HashKey.validate(config.Proxy.Mode); err != nil {
+		return err
+	}
+
+	switch config.Proxy.ShutdownMode {
+	case "":
+		config.Proxy.ShutdownMode = ShutdownModeShutdown
+	case ShutdownModeShutdown, ShutdownModeDrain:
+	default:
+		return fmt.Errorf("Invalid shutdown mode: %q", config.Proxy.ShutdownMode)
+	}
+	config.Proxy.Drain.setDefaults()
+	if err := config.Proxy.Drain.validate(); err != nil {
+		return err
+	}
+	config.Proxy.Retry.setDefaults()
+	if err := config.Proxy.Retry.validate(); err != nil {
+		return err
+	}
+	config.Proxy.Server.setDefaults()
+	if err := config.Proxy.Server.validate(); err != nil {
+		return err
+	}
+	config.Proxy.ProxyProtocol.setDefaults()
+	if err := config.Proxy.ProxyProtocol.validate(); err != nil {
+		return fmt.Errorf("Invalid proxy_protocol config: %v", err)
+	}
+	config.Proxy.Headers.setDefaults()
+	if err := config.Proxy.Headers.validate(); err != nil {
+		return fmt.Errorf("Invalid headers config: %v", err)
+	}
+	config.Proxy.AccessLog.setDefaults()
+	if err := config.Proxy.AccessLog.validate(); err != nil {
+		return fmt.Errorf("Invalid access_log config: %v", err)
+	}
+	config.Proxy.Queue.setDefaults()
+	if err := config.Proxy.Queue.validate(); err != nil {
+		return err
+	}
+	if config.Proxy.TLS.enabled() {
+		config.Proxy.TLS.setDefaults()
+		if _, err := buildTLSConfig(config.Proxy.TLS); err != nil {
+			return fmt.Errorf("Invalid tls config: %v", err)
+		}
+	}
+
+	if len(config.Backend) == 0 {
+		return fmt.Errorf("No backends configured")
+	}
+	names := make(map[string]bool, len(config.Backend))
 	for i, backend := range config.Backend {
+		// backends are identified by name across config reloads
+		if names[backend.Name] {
+			return fmt.Errorf("Duplicate backend name: %q", backend.Name)
+		}
+		names[backend.Name] = true
+		if backend.Weight > loadbalancer.MaxWeight {
+			return fmt.Errorf("Weight of backend %q is over %v: %v", backend.Name, loadbalancer.MaxWeight, backend.Weight)
+		}
+
+		if backend.Rise <= 0 {
+			config.Backend[i].Rise = 1
+		}
+		if backend.Fall <= 0 {
+			config.Backend[i].Fall = 1
+		}
+		config.Backend[i].Transport = backend.Transport.inherit(config.Proxy.Transport)
+
 		// convert to type url.URL
 		urlString := backend.Host + ":" + strconv.Itoa(backend.Port)
 		config.Backend[i].URL, err = url.Parse(urlString)
 		if err != nil {
-			return Config{}, fmt.Errorf("Invalid URL: %v", err)
+			return fmt.Errorf("Invalid URL: %v", err)
+		}
+
+		// the host may be given with or without a scheme
+		hostname := config.Backend[i].URL.Hostname()
+		if hostname == "" {
+			hostname = backend.Host
+		}
+		config.Backend[i].Address = net.JoinHostPort(hostname, strconv.Itoa(backend.Port))
+
+		// an https host implies tls and the other way around
+		if config.Backend[i].URL.Scheme == "https" {
+			config.Backend[i].TLS.Enabled = true
+		} else if backend.TLS.Enabled && config.Backend[i].URL.Scheme == "http" {
+			config.Backend[i].URL.Scheme = "https"
+		}
+		if _, err := config.Backend[i].clientTLSConfig(); err != nil {
+			return fmt.Errorf("Invalid tls config for backend %q: %v", backend.Name, err)
+		}
+
+		switch backend.ProxyProtocol {
+		case "":
+		case ProxyProtocolV1, ProxyProtocolV2:
+			if config.Proxy.Mode != ModeTCP {
+				return fmt.Errorf("Backend %q can only be sent the PROXY protocol in tcp mode", backend.Name)
+			}
+		default:
+			return fmt.Errorf("Invalid proxy_protocol for backend %q: %q", backend.Name, backend.ProxyProtocol)
+		}
+
+		if backend.HealthCheck.Type == "" {
+			config.Backend[i].HealthCheck.Type = HealthCheckHTTP
+		}
+		if backend.HealthCheck.Timeout <= 0 {
+			config.Backend[i].HealthCheck.Timeout = defaultHealthCheckTimeout
+		}
+		if _, err := NewHealthChecker(config.Backend[i]); err != nil {
+			return fmt.Errorf("Invalid health check for backend %q: %v", backend.Name, err)
 		}
 	}
-	return config, nil
+	return config.validateRouting()
 }
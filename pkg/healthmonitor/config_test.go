@@ -2,6 +2,9 @@ package healthmonitor
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -17,5 +20,307 @@ func TestParseConfig(t *testing.T) {
 	fmt.Println(config.Backend)
 	fmt.Println(config.Backend[0].HealthCheckInterval)
 
+	if config.Proxy.Mode != ModeHTTP {
+		t.Errorf("Expected mode %q, got %q", ModeHTTP, config.Proxy.Mode)
+	}
+	if config.Backend[0].Address != "localhost:3000" {
+		t.Errorf("Expected address localhost:3000, got %q", config.Backend[0].Address)
+	}
+	if config.Proxy.LBAlgorithm != "p2c" {
+		t.Errorf("Expected lb_algorithm p2c, got %q", config.Proxy.LBAlgorithm)
+	}
+
 	// should probably add some asserts here
 }
+
+func TestParseConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backends := `
+backend:
+  - name: "server_1"
+    host: "http://localhost"
+    port: 3000
+  - name: "server_2"
+    host: "http://localhost"
+    port: 3001
+`
+	invalid := map[string]string{
+		"mode":          "proxy:\n  mode: udp\n" + backends,
+		"lb_algorithm":  "proxy:\n  lb_algorithm: fastest\n" + backends,
+		"min_alive":     "proxy:\n  min_alive: 3\n" + backends,
+		"duplicate":     "proxy:\n  min_alive: 1\n" + backends + "  - name: \"server_1\"\n    host: \"http://localhost\"\n    port: 3002\n",
+		"health_check":  "proxy:\n  min_alive: 1\n" + backends + "    health_check:\n      type: exec\n",
+		"shutdown_mode": "proxy:\n  shutdown_mode: halt\n" + backends,
+		"drain":         "proxy:\n  drain:\n    status_code: 200\n" + backends,
+		"retry":         "proxy:\n  retry:\n    status_codes: [200]\n" + backends,
+		"retry_budget":  "proxy:\n  retry:\n    budget_percent: 0.05\n" + backends,
+		"tls":           "proxy:\n  tls:\n    certificates:\n      - cert_file: missing.crt\n        key_file: missing.key\n" + backends,
+		"server":        "proxy:\n  server:\n    overrides:\n      - path_prefix: stream\n" + backends,
+		"pool":          "proxy:\n  min_alive: 0\n" + backends + "    pool: api\n",
+		"route":         "routes:\n  - path_prefix: /api/\n    pool: api\n" + backends,
+		"pool_min":      "pools:\n  - name: api\n    min_alive: 1\n" + backends,
+		"tcp_routes":    "proxy:\n  mode: tcp\npools:\n  - name: api\n" + backends,
+		"proxy_cidrs":   "proxy:\n  proxy_protocol:\n    trusted_cidrs: [10.0.0.0]\n" + backends,
+		"proxy_http":    "proxy:\n  min_alive: 1\n" + backends + "    proxy_protocol: v2\n",
+		"headers":       "proxy:\n  headers:\n    x_real_ip: append\n" + backends,
+		"header_rules":  "proxy:\n  headers:\n    request:\n      set:\n        X-Backend: \"{{.Server}}\"\n" + backends,
+		"access_log":    "proxy:\n  access_log:\n    output: file\n" + backends,
+		"access_fields": "proxy:\n  access_log:\n    output: stdout\n    fields: [status, user_agent]\n" + backends,
+		"queue":         "proxy:\n  queue:\n    max_length: 10\n    order: random\n" + backends,
+		"admin":         "admin:\n  bind: :9001\n" + backends,
+		"admin_token":   "admin:\n  token_file: missing.token\n" + backends,
+		"buckets":       "metrics:\n  buckets: [1, 0.5]\n" + backends,
+		"no_backends":   "proxy:\n  mode: http\n",
+		"weight":        "proxy:\n  min_alive: 1\n" + backends + "    weight: 100000\n",
+		"empty_pool":    "pools:\n  - name: api\n" + backends,
+		"route_headers": "routes:\n  - path_prefix: /api/\n    pool: default\n    request_headers:\n      add:\n        X-Client: \"{{.ClientIP\"\n" + backends,
+	}
+	for name, yaml := range invalid {
+		configLocation := filepath.Join(dir, name+".yaml")
+		if err := ioutil.WriteFile(configLocation, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseConfig(configLocation); err == nil {
+			t.Errorf("Expected invalid %v to be rejected", name)
+		}
+	}
+}
+
+func TestParseConfigWeights(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yaml := `
+backend:
+  - name: "server_1"
+    host: "http://localhost"
+    port: 3000
+  - name: "server_2"
+    host: "http://localhost"
+    port: 3001
+    weight: 0
+  - name: "server_3"
+    host: "http://localhost"
+    port: 3002
+    weight: 4
+`
+	configLocation := filepath.Join(dir, "weights.yaml")
+	if err := ioutil.WriteFile(configLocation, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(configLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []uint32{1, 0, 4} {
+		if weight := config.Backend[i].Weight; weight != expected {
+			t.Errorf("Expected %v to have weight %v, got %v", config.Backend[i].Name, expected, weight)
+		}
+	}
+}
+
+func TestParseConfigFrontends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yaml := `
+proxy:
+  bind: ":8081"
+  max_conn: 100
+  name: "web"
+backend:
+  - name: "server_1"
+    host: "http://localhost"
+    port: 3000
+frontends:
+  - proxy:
+      bind: ":8081"
+      name: "web"
+  - proxy:
+      bind: ":8082"
+      mode: "tcp"
+      max_conn: 10
+      name: "db"
+    backend:
+      - name: "db_1"
+        host: "localhost"
+        port: 5432
+        health_check:
+          type: "tcp"
+`
+	configLocation := filepath.Join(dir, "frontends.yaml")
+	if err := ioutil.WriteFile(configLocation, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(configLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontends := config.FrontendConfigs()
+	if len(frontends) != 2 {
+		t.Fatalf("Expected 2 frontends, got %v", len(frontends))
+	}
+	web, db := frontends[0], frontends[1]
+	if web.Proxy.MaxConn != 100 || web.Proxy.Mode != ModeHTTP || len(web.Backend) != 1 || web.Backend[0].Name != "server_1" {
+		t.Errorf("Expected the web frontend to inherit the top level, got %+v", web)
+	}
+	if db.Proxy.MaxConn != 10 || db.Proxy.Mode != ModeTCP || len(db.Backend) != 1 || db.Backend[0].Address != "localhost:5432" {
+		t.Errorf("Expected the db frontend to override the top level, got %+v", db)
+	}
+
+	duplicate := yaml + `  - proxy:
+      bind: ":8083"
+      name: "db"
+`
+	if err := ioutil.WriteFile(configLocation, []byte(duplicate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfig(configLocation); err == nil {
+		t.Error("Expected duplicate frontend names to be rejected")
+	}
+
+	accessLogs := yaml + `  - proxy:
+      bind: ":8083"
+      name: "logs"
+      access_log:
+        output: "file"
+        path: "/tmp/access.log"
+  - proxy:
+      bind: ":8084"
+      name: "other_logs"
+      access_log:
+        output: "file"
+        path: "/tmp/access.log"
+        max_backups: 2
+`
+	if err := ioutil.WriteFile(configLocation, []byte(accessLogs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfig(configLocation); err == nil {
+		t.Error("Expected frontends rotating one access log differently to be rejected")
+	}
+}
+
+func TestParseConfigFrontendsOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yaml := `
+proxy:
+  max_conn: 100
+frontends:
+  - proxy:
+      bind: ":8081"
+      name: "web"
+    backend:
+      - name: "server_1"
+        host: "http://localhost"
+        port: 3000
+  - proxy:
+      bind: ":8082"
+      mode: "tcp"
+      name: "db"
+    backend:
+      - name: "db_1"
+        host: "localhost"
+        port: 5432
+        health_check:
+          type: "tcp"
+`
+	configLocation := filepath.Join(dir, "frontends.yaml")
+	if err := ioutil.WriteFile(configLocation, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(configLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontends := config.FrontendConfigs()
+	if len(frontends) != 2 {
+		t.Fatalf("Expected 2 frontends, got %v", len(frontends))
+	}
+	if web := frontends[0]; web.Proxy.MaxConn != 100 || len(web.Backend) != 1 || web.Backend[0].Address != "localhost:3000" {
+		t.Errorf("Expected the web frontend to have its own backends, got %+v", web)
+	}
+
+	// a frontend still needs backends, from the top level or its own
+	missing := yaml + `  - proxy:
+      bind: ":8083"
+      name: "empty"
+`
+	if err := ioutil.WriteFile(configLocation, []byte(missing), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfig(configLocation); err == nil {
+		t.Error("Expected a frontend without backends to be rejected")
+	}
+}
+
+func TestParseConfigFrontendHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yaml := `
+proxy:
+  headers:
+    request:
+      set:
+        X-Top: "a"
+backend:
+  - name: "server_1"
+    host: "http://localhost"
+    port: 3000
+frontends:
+  - proxy:
+      bind: ":8081"
+      name: "one"
+      headers:
+        request:
+          set:
+            X-One: "1"
+  - proxy:
+      bind: ":8082"
+      name: "two"
+      headers:
+        request:
+          add:
+            X-Two: "2"
+`
+	configLocation := filepath.Join(dir, "frontends.yaml")
+	if err := ioutil.WriteFile(configLocation, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(configLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if set := config.Proxy.Headers.Request.Set; len(set) != 1 || set["X-Top"] != "a" {
+		t.Errorf("Expected the top level to keep only its own header rules, got %v", set)
+	}
+	one, two := config.Frontends[0].Proxy.Headers.Request, config.Frontends[1].Proxy.Headers.Request
+	if len(one.Set) != 2 || one.Set["X-One"] != "1" || one.Set["X-Top"] != "a" || len(one.Add) != 0 {
+		t.Errorf("Expected frontend one to add X-One to the inherited rules, got %+v", one)
+	}
+	if len(two.Set) != 1 || two.Set["X-Top"] != "a" || len(two.Add) != 1 || two.Add["X-Two"] != "2" {
+		t.Errorf("Expected frontend two to only add X-Two to the inherited rules, got %+v", two)
+	}
+}
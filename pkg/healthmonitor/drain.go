@@ -0,0 +1,136 @@
+package healthmonitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Shutdown modes, which decide what happens to the proxy server once fewer
+// than min_alive backends are healthy
+const (
+	// ShutdownModeShutdown closes the listener so upstream load balancers
+	// see refused connections, and restarts the server once it recovers
+	ShutdownModeShutdown = "shutdown"
+	// ShutdownModeDrain keeps the listener up, fails /status and answers new
+	// requests with an error while in-flight requests finish
+	ShutdownModeDrain = "drain"
+)
+
+const (
+	defaultDrainTimeout    = 30 * time.Second
+	defaultDrainRetryAfter = 5 * time.Second
+)
+
+// DrainConfig configures the drain shutdown mode. In-flight requests are
+// aborted once Timeout has passed, new requests get StatusCode and Body with
+// a Retry-After header of RetryAfter rounded up to whole seconds. Timeout
+// also bounds how long the shutdown mode waits for open connections
+type DrainConfig struct {
+	Timeout    time.Duration `yaml:"timeout"`
+	RetryAfter time.Duration `yaml:"retry_after"`
+	StatusCode int           `yaml:"status_code"`
+	Body       string        `yaml:"body"`
+}
+
+func (config *DrainConfig) setDefaults() {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultDrainTimeout
+	}
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = defaultDrainRetryAfter
+	}
+	if config.StatusCode == 0 {
+		config.StatusCode = http.StatusServiceUnavailable
+	}
+}
+
+func (config DrainConfig) validate() error {
+	if config.StatusCode < 400 || config.StatusCode > 599 {
+		return fmt.Errorf("Invalid drain status_code: %v", config.StatusCode)
+	}
+	return nil
+}
+
+// drain keeps the server listening but refuses new requests, and aborts the
+// requests in flight once the drain timeout expires
+func (proxyServer *ProxyServer) drain() {
+	proxyServer.drainMu.Lock()
+	defer proxyServer.drainMu.Unlock()
+	ph := &proxyServer.ph
+	if !atomic.CompareAndSwapUint32(&ph.draining, 0, 1) {
+		return
+	}
+	log.Println("Draining proxy server")
+	proxyServer.metrics.timeHealthy.With(proxyServer.nameLabel).Observe(proxyServer.resetTimer())
+	proxyServer.drainTimer = time.AfterFunc(ph.getDrainConfig().Timeout, proxyServer.abortCancel)
+}
+
+// resume puts a draining server back into service, it does nothing if the
+// server is not draining
+func (proxyServer *ProxyServer) resume() {
+	proxyServer.drainMu.Lock()
+	defer proxyServer.drainMu.Unlock()
+	ph := &proxyServer.ph
+	if atomic.LoadUint32(&ph.draining) == 0 {
+		return
+	}
+	proxyServer.drainTimer.Stop()
+	// requests admitted from now on must not be aborted by an earlier drain
+	proxyServer.newAbortContext()
+	atomic.StoreUint32(&ph.draining, 0)
+	log.Println("Resuming proxy server")
+	proxyServer.metrics.timeUnhealthy.With(proxyServer.nameLabel).Observe(proxyServer.resetTimer())
+}
+
+// newAbortContext must be called with drainMu held or before the server starts
+func (proxyServer *ProxyServer) newAbortContext() {
+	ctx, cancel := context.WithCancel(context.Background())
+	proxyServer.abortCancel = cancel
+	proxyServer.ph.abort.Store(ctx)
+}
+
+func (ph *proxyHandler) isDraining() bool {
+	return atomic.LoadUint32(&ph.draining) == 1
+}
+
+func (ph *proxyHandler) setDrainConfig(config DrainConfig) {
+	config.setDefaults()
+	ph.drainConfig.Store(config)
+}
+
+func (ph *proxyHandler) getDrainConfig() DrainConfig {
+	return ph.drainConfig.Load().(DrainConfig)
+}
+
+// withDrainDeadline returns a context that is also cancelled when the drain
+// timeout expires, for a drain that starts while the context is in use
+func (ph *proxyHandler) withDrainDeadline(parent context.Context) (context.Context, context.CancelFunc) {
+	abort := ph.abort.Load().(context.Context)
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-abort.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// serveDraining answers a request received while the server drains
+func (ph *proxyHandler) serveDraining(w http.ResponseWriter) {
+	config := ph.getDrainConfig()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(config.RetryAfter.Seconds()))))
+	// make clients reconnect, hopefully to a healthy proxy
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(config.StatusCode)
+	io.WriteString(w, config.Body)
+}
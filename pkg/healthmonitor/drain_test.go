@@ -0,0 +1,125 @@
+package healthmonitor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDrainShutdownMode(t *testing.T) {
+	release := make(chan struct{})
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	config.Proxy.MaxConn = 10
+	config.Proxy.MinAlive = 1
+	config.Proxy.Name = "drain_test"
+	config.Proxy.ShutdownMode = ShutdownModeDrain
+	config.Proxy.Drain = DrainConfig{Timeout: 200 * time.Millisecond, RetryAfter: 1500 * time.Millisecond, Body: "draining"}
+	config.Backend = []BackendPort{
+		{Name: "server_1", Rise: 1, Fall: 1, URL: downstreamURL},
+		{Name: "server_2", Rise: 1, Fall: 1, URL: downstreamURL},
+	}
+
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	check := healthMonitor.checks["server_1"]
+	go proxy.Start()
+	defer proxy.shutdown()
+	defer close(release)
+
+	base := "http://" + config.Proxy.Bind
+	var response *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if response, err = http.Get(base + "/status"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %v", response.StatusCode)
+	}
+
+	slow := make(chan int, 1)
+	go func() {
+		response, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		response.Body.Close()
+		slow <- response.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	healthMonitor.observe(check, false)
+	if !proxy.ph.isDraining() {
+		t.Fatal("Expected the proxy to drain once the pool is unhealthy")
+	}
+
+	response, err = http.Get(base + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected /status to fail while draining, got %v", response.StatusCode)
+	}
+
+	response, err = http.Get(base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while draining, got %v", response.StatusCode)
+	}
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", retryAfter)
+	}
+	if string(body) != "draining" {
+		t.Errorf("Expected body %q, got %q", "draining", body)
+	}
+
+	select {
+	case code := <-slow:
+		if code != http.StatusBadGateway {
+			t.Errorf("Expected the in-flight request to be aborted, got %v", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("In-flight request was not aborted after the drain timeout")
+	}
+
+	healthMonitor.observe(check, true)
+	if proxy.ph.isDraining() {
+		t.Fatal("Expected the proxy to resume once the pool recovers")
+	}
+	response, err = http.Get(base + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 after resuming, got %v", response.StatusCode)
+	}
+}
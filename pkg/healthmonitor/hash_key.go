@@ -0,0 +1,66 @@
+package healthmonitor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Sources the hashing load balancers can derive their key from
+const (
+	HashKeyClientIP = "client_ip"
+	HashKeyHeader   = "header"
+	HashKeyCookie   = "cookie"
+	HashKeyPath     = "path"
+)
+
+// HashKeyConfig selects what requests are hashed on by the ring_hash and
+// maglev load balancers. Name is the header or cookie name
+type HashKeyConfig struct {
+	Source string `yaml:"source"`
+	Name   string `yaml:"name"`
+}
+
+func (config HashKeyConfig) validate(mode string) error {
+	switch config.Source {
+	case "", HashKeyClientIP:
+	case HashKeyHeader, HashKeyCookie:
+		if config.Name == "" {
+			return fmt.Errorf("hash_key source %v needs a name", config.Source)
+		}
+	case HashKeyPath:
+	default:
+		return fmt.Errorf("Unknown hash_key source: %q", config.Source)
+	}
+	if mode == ModeTCP && config.Source != "" && config.Source != HashKeyClientIP {
+		return fmt.Errorf("tcp mode can only hash on %v", HashKeyClientIP)
+	}
+	return nil
+}
+
+// requestHashKey derives the hash key of an http request, an empty key
+// makes the hashing load balancers pick a random backend
+func requestHashKey(config HashKeyConfig, r *http.Request) string {
+	switch config.Source {
+	case HashKeyHeader:
+		return r.Header.Get(config.Name)
+	case HashKeyCookie:
+		cookie, err := r.Cookie(config.Name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case HashKeyPath:
+		return r.URL.Path
+	}
+	return clientIP(r.RemoteAddr)
+}
+
+// clientIP strips the port from a remote address
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,39 @@
+package healthmonitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestHashKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/users/42?page=1", nil)
+	r.RemoteAddr = "10.1.2.3:51234"
+	r.Header.Set("X-User", "alice")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc123"})
+
+	tests := []struct {
+		config HashKeyConfig
+		key    string
+	}{
+		{HashKeyConfig{}, "10.1.2.3"},
+		{HashKeyConfig{Source: HashKeyClientIP}, "10.1.2.3"},
+		{HashKeyConfig{Source: HashKeyHeader, Name: "X-User"}, "alice"},
+		{HashKeyConfig{Source: HashKeyHeader, Name: "X-Missing"}, ""},
+		{HashKeyConfig{Source: HashKeyCookie, Name: "session"}, "abc123"},
+		{HashKeyConfig{Source: HashKeyCookie, Name: "missing"}, ""},
+		{HashKeyConfig{Source: HashKeyPath}, "/users/42"},
+	}
+	for _, test := range tests {
+		if key := requestHashKey(test.config, r); key != test.key {
+			t.Errorf("%+v: expected key %q, got %q", test.config, test.key, key)
+		}
+	}
+
+	if err := (HashKeyConfig{Source: HashKeyHeader}).validate(ModeHTTP); err == nil {
+		t.Error("Expected a header source without a name to be rejected")
+	}
+	if err := (HashKeyConfig{Source: HashKeyPath}).validate(ModeTCP); err == nil {
+		t.Error("Expected a path source to be rejected in tcp mode")
+	}
+}
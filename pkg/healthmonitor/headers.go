@@ -0,0 +1,405 @@
+package healthmonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// How a forwarding header is handled
+const (
+	// HeaderKeep passes on what the client sent
+	HeaderKeep = "keep"
+	// HeaderAppend adds the value of this hop to what the client sent
+	HeaderAppend = "append"
+	// HeaderSet replaces what the client sent with the value of this hop
+	HeaderSet = "set"
+	// HeaderRemove drops the header
+	HeaderRemove = "remove"
+	// HeaderGenerate sets a request id unless the client sent one
+	HeaderGenerate = "generate"
+)
+
+const defaultRequestIDHeader = "X-Request-ID"
+
+// HeadersConfig controls the headers of proxied requests and responses. The
+// forwarding headers take a mode and default to keep, except
+// X-Forwarded-For which the reverse proxy always appends to unless set.
+// RequestID is keep, generate or set, and the id is returned to the client.
+// Request and Response are rewrite rules applied to every request, before
+// those of the route
+type HeadersConfig struct {
+	Forwarded       string      `yaml:"forwarded"`
+	XForwardedFor   string      `yaml:"x_forwarded_for"`
+	XForwardedProto string      `yaml:"x_forwarded_proto"`
+	XForwardedHost  string      `yaml:"x_forwarded_host"`
+	XForwardedPort  string      `yaml:"x_forwarded_port"`
+	XRealIP         string      `yaml:"x_real_ip"`
+	RequestID       string      `yaml:"request_id"`
+	RequestIDHeader string      `yaml:"request_id_header"`
+	Request         HeaderRules `yaml:"request"`
+	Response        HeaderRules `yaml:"response"`
+}
+
+// HeaderRules rewrite the headers of a request or response. Headers are
+// removed first, then set, then added to. Values are templates rendered
+// with the fields of headerTemplateData, like "{{.ClientIP}}"
+type HeaderRules struct {
+	Remove []string          `yaml:"remove"`
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+}
+
+// headerTemplateData is what header rule values are rendered with
+type headerTemplateData struct {
+	Backend   string
+	Pool      string
+	ClientIP  string
+	RequestID string
+	Host      string
+}
+
+func (config *HeadersConfig) setDefaults() {
+	for _, mode := range []*string{&config.Forwarded, &config.XForwardedProto, &config.XForwardedHost, &config.XForwardedPort, &config.XRealIP, &config.RequestID} {
+		if *mode == "" {
+			*mode = HeaderKeep
+		}
+	}
+	if config.XForwardedFor == "" {
+		config.XForwardedFor = HeaderAppend
+	}
+	if config.RequestIDHeader == "" {
+		config.RequestIDHeader = defaultRequestIDHeader
+	}
+}
+
+func (config HeadersConfig) validate() error {
+	modes := map[string][]string{
+		"forwarded":         {config.Forwarded, HeaderKeep, HeaderAppend, HeaderSet, HeaderRemove},
+		"x_forwarded_proto": {config.XForwardedProto, HeaderKeep, HeaderAppend, HeaderSet, HeaderRemove},
+		"x_forwarded_host":  {config.XForwardedHost, HeaderKeep, HeaderAppend, HeaderSet, HeaderRemove},
+		"x_forwarded_port":  {config.XForwardedPort, HeaderKeep, HeaderAppend, HeaderSet, HeaderRemove},
+		// the reverse proxy always adds the client to X-Forwarded-For
+		"x_forwarded_for": {config.XForwardedFor, HeaderAppend, HeaderSet},
+		"x_real_ip":       {config.XRealIP, HeaderKeep, HeaderSet, HeaderRemove},
+		"request_id":      {config.RequestID, HeaderKeep, HeaderGenerate, HeaderSet},
+	}
+	for name, mode := range modes {
+		if !containsString(mode[1:], mode[0]) {
+			return fmt.Errorf("Invalid %v mode: %q", name, mode[0])
+		}
+	}
+	if _, err := compileHeaderRules(config.Request); err != nil {
+		return err
+	}
+	_, err := compileHeaderRules(config.Response)
+	return err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// headerRules are compiled HeaderRules
+type headerRules struct {
+	remove []string
+	set    map[string]*template.Template
+	add    map[string]*template.Template
+}
+
+func compileHeaderRules(config HeaderRules) (*headerRules, error) {
+	rules := &headerRules{remove: config.Remove}
+	var err error
+	if rules.set, err = compileHeaderTemplates(config.Set); err != nil {
+		return nil, err
+	}
+	if rules.add, err = compileHeaderTemplates(config.Add); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func compileHeaderTemplates(values map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(values))
+	for name, value := range values {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template for header %v: %v", name, err)
+		}
+		// catch unknown fields now rather than on every request
+		if err := tmpl.Execute(&bytes.Buffer{}, headerTemplateData{}); err != nil {
+			return nil, fmt.Errorf("Invalid template for header %v: %v", name, err)
+		}
+		templates[http.CanonicalHeaderKey(name)] = tmpl
+	}
+	return templates, nil
+}
+
+// apply rewrites header, and returns the header values it added
+func (rules *headerRules) apply(header http.Header, data headerTemplateData) [][2]string {
+	if rules == nil {
+		return nil
+	}
+	for _, name := range rules.remove {
+		header.Del(name)
+	}
+	for name, tmpl := range rules.set {
+		header.Set(name, renderHeader(tmpl, data))
+	}
+	var added [][2]string
+	for name, tmpl := range rules.add {
+		value := renderHeader(tmpl, data)
+		header.Add(name, value)
+		added = append(added, [2]string{name, value})
+	}
+	return added
+}
+
+func renderHeader(tmpl *template.Template, data headerTemplateData) string {
+	var value bytes.Buffer
+	// templates were checked against the same data when compiled
+	tmpl.Execute(&value, data)
+	return value.String()
+}
+
+// headerPolicy is the compiled HeadersConfig of a proxy
+type headerPolicy struct {
+	config   HeadersConfig
+	request  *headerRules
+	response *headerRules
+}
+
+func (ph *proxyHandler) setHeadersConfig(config HeadersConfig) {
+	config.setDefaults()
+	policy := &headerPolicy{config: config}
+	// the config was validated when parsed
+	policy.request, _ = compileHeaderRules(config.Request)
+	policy.response, _ = compileHeaderRules(config.Response)
+	ph.headers.Store(policy)
+}
+
+func (ph *proxyHandler) getHeaderPolicy() *headerPolicy {
+	return ph.headers.Load().(*headerPolicy)
+}
+
+type requestInfoKey struct{}
+
+// requestInfo follows a request from ServeHTTP to the director, transport
+// and ModifyResponse of the reverse proxy
+type requestInfo struct {
+	policy    *headerPolicy
+	route     *route
+	requestID string
+	clientIP  string
+	// backend is the backend of the current attempt
+	backend string
+	// added are the header values the rules added to the current attempt,
+	// which are taken out again before the rules are applied to a retry
+	added [][2]string
+	// attempts and upstreamLatency are kept by the transport for the access log
+	attempts        int
+	upstreamLatency time.Duration
+}
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// newRequestInfo assigns a request its id according to the policy, its route
+// is filled in once known
+func newRequestInfo(r *http.Request, policy *headerPolicy) *requestInfo {
+	info := &requestInfo{policy: policy, clientIP: clientIP(r.RemoteAddr)}
+	header := policy.config.RequestIDHeader
+	info.requestID = r.Header.Get(header)
+	switch policy.config.RequestID {
+	case HeaderGenerate:
+		if info.requestID == "" {
+			info.requestID = newRequestID()
+		}
+	case HeaderSet:
+		info.requestID = newRequestID()
+	}
+	if policy.config.RequestID != HeaderKeep {
+		r.Header.Set(header, info.requestID)
+	}
+	return info
+}
+
+// newRequestID returns a random version 4 UUID
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+func (info *requestInfo) templateData(r *http.Request) headerTemplateData {
+	data := headerTemplateData{
+		Backend:   info.backend,
+		ClientIP:  info.clientIP,
+		RequestID: info.requestID,
+		Host:      r.Host,
+	}
+	if info.route != nil && info.route.pool != nil {
+		data.Pool = info.route.pool.name
+	}
+	return data
+}
+
+// rewriteRequest is called by the director of the reverse proxy with the
+// outgoing request, after the request has been pointed at backend
+func rewriteRequest(r *http.Request, backend string) {
+	info := getRequestInfo(r.Context())
+	if info == nil {
+		return
+	}
+	setForwardingHeaders(r, info.policy.config, info.clientIP)
+	info.backend = backend
+	info.applyRequestRules(r)
+}
+
+// rewriteRetry applies the rewrite rules again to a retry on another backend
+func rewriteRetry(r *http.Request, backend string) {
+	info := getRequestInfo(r.Context())
+	if info == nil {
+		return
+	}
+	// the retry shares its header with the previous attempt
+	r.Header = cloneHeader(r.Header)
+	for _, value := range info.added {
+		removeHeaderValue(r.Header, value[0], value[1])
+	}
+	info.backend = backend
+	info.applyRequestRules(r)
+}
+
+func (info *requestInfo) applyRequestRules(r *http.Request) {
+	data := info.templateData(r)
+	info.added = info.policy.request.apply(r.Header, data)
+	if info.route != nil {
+		info.added = append(info.added, info.route.requestHeaders.apply(r.Header, data)...)
+	}
+}
+
+// removeHeaderValue removes a single value of a header
+func removeHeaderValue(header http.Header, name, value string) {
+	values := header[name]
+	for i, v := range values {
+		if v == value {
+			header[name] = append(values[:i:i], values[i+1:]...)
+			if len(header[name]) == 0 {
+				delete(header, name)
+			}
+			return
+		}
+	}
+}
+
+// rewriteResponse is the ModifyResponse of the reverse proxies
+func rewriteResponse(response *http.Response) error {
+	info := getRequestInfo(response.Request.Context())
+	if info == nil {
+		return nil
+	}
+	if info.policy.config.RequestID != HeaderKeep {
+		response.Header.Set(info.policy.config.RequestIDHeader, info.requestID)
+	}
+	data := info.templateData(response.Request)
+	info.policy.response.apply(response.Header, data)
+	if info.route != nil {
+		info.route.responseHeaders.apply(response.Header, data)
+	}
+	return nil
+}
+
+// setForwardingHeaders sets the forwarding headers of an outgoing request.
+// X-Forwarded-For is added by the reverse proxy itself afterwards
+func setForwardingHeaders(r *http.Request, config HeadersConfig, clientIP string) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	port := ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		_, port, _ = net.SplitHostPort(addr.String())
+	}
+
+	forwarded := "for=" + forwardedNode(clientIP)
+	if r.Host != "" {
+		forwarded += ";host=" + quoteForwarded(r.Host)
+	}
+	forwarded += ";proto=" + proto
+
+	applyForwardingHeader(r.Header, "Forwarded", config.Forwarded, forwarded)
+	applyForwardingHeader(r.Header, "X-Forwarded-Proto", config.XForwardedProto, proto)
+	applyForwardingHeader(r.Header, "X-Forwarded-Host", config.XForwardedHost, r.Host)
+	applyForwardingHeader(r.Header, "X-Forwarded-Port", config.XForwardedPort, port)
+	applyForwardingHeader(r.Header, "X-Real-IP", config.XRealIP, clientIP)
+	if config.XForwardedFor == HeaderSet {
+		// the reverse proxy adds the client to what is left
+		r.Header.Del("X-Forwarded-For")
+	}
+}
+
+func applyForwardingHeader(header http.Header, name, mode, value string) {
+	switch mode {
+	case HeaderAppend:
+		// without a value for this hop the chain is passed on as it is
+		if value == "" {
+			return
+		}
+		if prior := header[name]; len(prior) > 0 {
+			value = strings.Join(prior, ", ") + ", " + value
+		}
+		fallthrough
+	case HeaderSet:
+		if value == "" {
+			header.Del(name)
+			return
+		}
+		header.Set(name, value)
+	case HeaderRemove:
+		header.Del(name)
+	}
+}
+
+// forwardedNode formats an address for the Forwarded header, which needs
+// IPv6 addresses bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\" ;,") {
+		return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+	}
+	return value
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
@@ -0,0 +1,219 @@
+package healthmonitor
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/wish/tcp-mux-proxy/pkg/loadbalancer"
+)
+
+func TestSetForwardingHeaders(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 8443}
+	for _, test := range []struct {
+		config   HeadersConfig
+		tls      bool
+		client   string
+		incoming map[string]string
+		expected map[string]string
+	}{
+		// keep passes on whatever the client sent
+		{
+			HeadersConfig{},
+			false,
+			"203.0.113.7",
+			map[string]string{"X-Forwarded-Proto": "https", "X-Real-Ip": "10.0.0.1"},
+			map[string]string{"Forwarded": "", "X-Forwarded-Proto": "https", "X-Real-Ip": "10.0.0.1"},
+		},
+		{
+			HeadersConfig{Forwarded: HeaderSet, XForwardedProto: HeaderSet, XForwardedHost: HeaderSet, XForwardedPort: HeaderSet, XRealIP: HeaderSet},
+			true,
+			"203.0.113.7",
+			map[string]string{"X-Forwarded-Proto": "http", "X-Real-Ip": "10.0.0.1"},
+			map[string]string{
+				"Forwarded":         "for=203.0.113.7;host=example.com;proto=https",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "example.com",
+				"X-Forwarded-Port":  "8443",
+				"X-Real-Ip":         "203.0.113.7",
+			},
+		},
+		{
+			HeadersConfig{Forwarded: HeaderAppend, XForwardedHost: HeaderAppend},
+			false,
+			"2001:db8::7",
+			map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-Host": "front.example.com"},
+			map[string]string{
+				"Forwarded":        `for=192.0.2.60, for="[2001:db8::7]";host=example.com;proto=http`,
+				"X-Forwarded-Host": "front.example.com, example.com",
+			},
+		},
+		{
+			HeadersConfig{Forwarded: HeaderRemove, XRealIP: HeaderRemove, XForwardedFor: HeaderSet},
+			false,
+			"203.0.113.7",
+			map[string]string{"Forwarded": "for=192.0.2.60", "X-Real-Ip": "10.0.0.1", "X-Forwarded-For": "10.0.0.1"},
+			map[string]string{"Forwarded": "", "X-Real-Ip": "", "X-Forwarded-For": ""},
+		},
+	} {
+		test.config.setDefaults()
+		request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, local))
+		if test.tls {
+			request.TLS = &tls.ConnectionState{}
+		}
+		for name, value := range test.incoming {
+			request.Header.Set(name, value)
+		}
+		setForwardingHeaders(request, test.config, test.client)
+		for name, value := range test.expected {
+			if actual := strings.Join(request.Header[name], ", "); actual != value {
+				t.Errorf("Expected %v to be %q with %+v, got %q", name, value, test.config, actual)
+			}
+		}
+	}
+}
+
+func TestAppendForwardingHeadersWithoutValue(t *testing.T) {
+	var config HeadersConfig
+	config.XForwardedHost, config.XForwardedPort = HeaderAppend, HeaderAppend
+	config.setDefaults()
+
+	// no local address to take the port from and no host
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Host = ""
+	request.Header.Set("X-Forwarded-Host", "front.example.com")
+	request.Header.Set("X-Forwarded-Port", "443")
+	setForwardingHeaders(request, config, "203.0.113.7")
+	for name, value := range map[string]string{"X-Forwarded-Host": "front.example.com", "X-Forwarded-Port": "443"} {
+		if actual := strings.Join(request.Header[name], ", "); actual != value {
+			t.Errorf("Expected %v to keep %q, got %q", name, value, actual)
+		}
+	}
+}
+
+func TestHeaderRewrite(t *testing.T) {
+	received := make(chan http.Header, 10)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.Header().Set("X-Powered-By", "test")
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "headers_test"
+	config.Proxy.Headers = HeadersConfig{
+		XRealIP:   HeaderSet,
+		RequestID: HeaderGenerate,
+		Request:   HeaderRules{Set: map[string]string{"X-Backend": "{{.Backend}}"}},
+		Response:  HeaderRules{Remove: []string{"X-Powered-By"}},
+	}
+	config.Pools = []PoolConfig{{Name: "api"}}
+	config.Routes = []RouteConfig{{
+		PathPrefix:      "/api/",
+		Pool:            "api",
+		RequestHeaders:  HeaderRules{Remove: []string{"Cookie"}, Add: map[string]string{"X-Client": "{{.ClientIP}} via {{.Pool}}"}},
+		ResponseHeaders: HeaderRules{Set: map[string]string{"X-Served-By": "{{.Backend}}"}},
+	}}
+	config.Backend = []BackendPort{
+		{Name: "server_1", URL: downstreamURL},
+		{Name: "api_1", Pool: "api", URL: downstreamURL},
+	}
+	proxy := NewProxyServer(&config)
+
+	serve := func(path string, headers map[string]string) (*httptest.ResponseRecorder, http.Header) {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		proxy.ph.ServeHTTP(recorder, request)
+		return recorder, <-received
+	}
+
+	recorder, header := serve("/", nil)
+	if value := header.Get("X-Backend"); value != "server_1" {
+		t.Errorf("Expected the backend to be templated, got %q", value)
+	}
+	if value := header.Get("X-Real-Ip"); value != "192.0.2.1" {
+		t.Errorf("Expected X-Real-IP to be the client, got %q", value)
+	}
+	requestID := header.Get("X-Request-Id")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(requestID) {
+		t.Errorf("Expected a generated request id, got %q", requestID)
+	}
+	if value := recorder.Header().Get("X-Request-Id"); value != requestID {
+		t.Errorf("Expected the request id %q in the response, got %q", requestID, value)
+	}
+	if value := recorder.Header().Get("X-Powered-By"); value != "" {
+		t.Errorf("Expected X-Powered-By to be removed, got %q", value)
+	}
+	if value := recorder.Header().Get("X-Served-By"); value != "" {
+		t.Errorf("Expected the rules of the api route to be left out, got %q", value)
+	}
+
+	recorder, header = serve("/api/users", map[string]string{"Cookie": "session=1", "X-Request-Id": "abc"})
+	if value := header.Get("X-Request-Id"); value != "abc" {
+		t.Errorf("Expected the request id of the client to be kept, got %q", value)
+	}
+	if value := header.Get("Cookie"); value != "" {
+		t.Errorf("Expected the cookie to be removed, got %q", value)
+	}
+	if value := header.Get("X-Client"); value != "192.0.2.1 via api" {
+		t.Errorf("Expected the route rules to be applied, got %q", value)
+	}
+	if value := recorder.Header().Get("X-Served-By"); value != "api_1" {
+		t.Errorf("Expected the response rules of the route to be applied, got %q", value)
+	}
+}
+
+func TestHeaderRewriteRetry(t *testing.T) {
+	received := make(chan http.Header, 1)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer healthy.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "headers_retry_test"
+	config.Proxy.LBAlgorithm = loadbalancer.RoundRobin
+	config.Proxy.Retry = RetryConfig{Attempts: 2, StatusCodes: []int{http.StatusServiceUnavailable}}
+	config.Proxy.Headers.Request = HeaderRules{
+		Set: map[string]string{"X-Backend": "{{.Backend}}"},
+		Add: map[string]string{"X-Attempt": "{{.Backend}}"},
+	}
+	for i, target := range []string{unavailable.URL, healthy.URL} {
+		targetURL, _ := url.Parse(target)
+		config.Backend = append(config.Backend, BackendPort{Name: []string{"unavailable", "healthy"}[i], URL: targetURL})
+	}
+	proxy := NewProxyServer(&config)
+
+	recorder := httptest.NewRecorder()
+	proxy.ph.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the request to be retried, got %v", recorder.Code)
+	}
+	header := <-received
+	if value := header.Get("X-Backend"); value != "healthy" {
+		t.Errorf("Expected the retry to be templated with its backend, got %q", value)
+	}
+	if values := header["X-Attempt"]; len(values) != 1 || values[0] != "healthy" {
+		t.Errorf("Expected only the value added for the retry, got %q", values)
+	}
+	if value := header.Get("X-Forwarded-For"); value != "192.0.2.1" {
+		t.Errorf("Expected X-Forwarded-For on the retry, got %q", value)
+	}
+}
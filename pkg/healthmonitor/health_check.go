@@ -0,0 +1,265 @@
+package healthmonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Health check types
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+	HealthCheckGRPC = "grpc"
+	HealthCheckExec = "exec"
+)
+
+const (
+	defaultHealthCheckTimeout = time.Second
+	// maxHealthCheckBody limits how much of a response is matched against body_regex
+	maxHealthCheckBody = 1 << 20
+)
+
+// HealthChecker checks the health of a single backend. Check returns nil if
+// the backend is healthy and should give up once ctx is done. Checkers that
+// hold resources may also implement io.Closer, they are closed once the
+// backend is no longer monitored
+type HealthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// NewHealthChecker builds the health checker configured for a backend
+func NewHealthChecker(backend BackendPort) (HealthChecker, error) {
+	config := backend.HealthCheck
+	if config.Checker != nil {
+		return config.Checker, nil
+	}
+	// health checks connect the same way as proxied traffic
+	tlsConfig, err := backend.clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Type {
+	case "", HealthCheckHTTP:
+		return newHTTPHealthChecker(backend, tlsConfig)
+	case HealthCheckTCP:
+		return &tcpHealthChecker{address: backend.Address, tlsConfig: tlsConfig}, nil
+	case HealthCheckGRPC:
+		return &grpcHealthChecker{address: backend.Address, service: config.Service, tlsConfig: tlsConfig}, nil
+	case HealthCheckExec:
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("exec health check needs a command")
+		}
+		return &execHealthChecker{command: config.Command}, nil
+	}
+	return nil, fmt.Errorf("Unknown health check type: %q", config.Type)
+}
+
+type httpHealthChecker struct {
+	client         http.Client
+	endpoint       string
+	method         string
+	host           string
+	headers        map[string]string
+	expectedStatus map[int]bool
+	bodyRegex      *regexp.Regexp
+}
+
+func newHTTPHealthChecker(backend BackendPort, tlsConfig *tls.Config) (*httpHealthChecker, error) {
+	config := backend.HealthCheck
+	checker := &httpHealthChecker{
+		method:  config.Method,
+		host:    config.Host,
+		headers: config.Headers,
+	}
+	if tlsConfig != nil {
+		checker.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	if backend.URL != nil {
+		checker.endpoint = backend.URL.String() + backend.HealthCheckEndpoint
+	}
+	if checker.method == "" {
+		checker.method = http.MethodGet
+	}
+	if len(config.ExpectedStatus) > 0 {
+		checker.expectedStatus = make(map[int]bool, len(config.ExpectedStatus))
+		for _, code := range config.ExpectedStatus {
+			checker.expectedStatus[code] = true
+		}
+	}
+	if config.BodyRegex != "" {
+		bodyRegex, err := regexp.Compile(config.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid body_regex: %v", err)
+		}
+		checker.bodyRegex = bodyRegex
+	}
+	return checker, nil
+}
+
+func (checker *httpHealthChecker) Check(ctx context.Context) error {
+	req, err := http.NewRequest(checker.method, checker.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	if checker.host != "" {
+		req.Host = checker.host
+	}
+	for key, value := range checker.headers {
+		req.Header.Set(key, value)
+	}
+
+	response, err := checker.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if checker.expectedStatus != nil {
+		if !checker.expectedStatus[response.StatusCode] {
+			return fmt.Errorf("Unexpected status code %v", response.StatusCode)
+		}
+	} else if response.StatusCode >= 400 {
+		return fmt.Errorf("Unhealthy status code %v", response.StatusCode)
+	}
+
+	if checker.bodyRegex == nil {
+		io.Copy(ioutil.Discard, response.Body)
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxHealthCheckBody))
+	if err != nil {
+		return err
+	}
+	if !checker.bodyRegex.Match(body) {
+		return fmt.Errorf("Response body does not match %q", checker.bodyRegex)
+	}
+	return nil
+}
+
+// tcpHealthChecker connects to the backend, completing a tls handshake if
+// the backend uses tls
+type tcpHealthChecker struct {
+	address   string
+	tlsConfig *tls.Config
+}
+
+func (checker *tcpHealthChecker) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", checker.address)
+	if err != nil {
+		return err
+	}
+	if checker.tlsConfig == nil {
+		return conn.Close()
+	}
+
+	tlsConn := tls.Client(conn, checker.tlsConfig)
+	defer tlsConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+	return tlsConn.Handshake()
+}
+
+// grpcHealthChecker implements the standard grpc.health.v1.Health/Check
+// protocol. The connection is dialed on the first check and reused after
+type grpcHealthChecker struct {
+	address   string
+	service   string
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn *grpc.ClientConn
+}
+
+// client dials the connection on the first check, the dial is bounded by the
+// check timeout of ctx
+func (checker *grpcHealthChecker) client(ctx context.Context) (healthpb.HealthClient, error) {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	if checker.conn == nil {
+		creds := insecure.NewCredentials()
+		if checker.tlsConfig != nil {
+			creds = credentials.NewTLS(checker.tlsConfig)
+		}
+		conn, err := grpc.DialContext(ctx, checker.address, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+		if err != nil {
+			return nil, err
+		}
+		checker.conn = conn
+	}
+	return healthpb.NewHealthClient(checker.conn), nil
+}
+
+func (checker *grpcHealthChecker) Check(ctx context.Context) error {
+	client, err := checker.client(ctx)
+	if err != nil {
+		return err
+	}
+	response, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: checker.service})
+	if err != nil {
+		return err
+	}
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("Service status is %v", response.Status)
+	}
+	return nil
+}
+
+func (checker *grpcHealthChecker) Close() error {
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	if checker.conn == nil {
+		return nil
+	}
+	err := checker.conn.Close()
+	checker.conn = nil
+	return err
+}
+
+// execHealthChecker runs a local command, a zero exit status means healthy
+type execHealthChecker struct {
+	command []string
+}
+
+func (checker *execHealthChecker) Check(ctx context.Context) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, checker.command[0], checker.command[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("%v: %v", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// errorHealthChecker reports a backend whose checker could not be built as
+// unhealthy
+type errorHealthChecker struct {
+	err error
+}
+
+func (checker *errorHealthChecker) Check(ctx context.Context) error {
+	return checker.err
+}
@@ -0,0 +1,141 @@
+package healthmonitor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func runHealthCheck(t *testing.T, backend BackendPort) error {
+	checker, err := NewHealthChecker(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return checker.Check(ctx)
+}
+
+func TestHTTPHealthCheck(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "status.internal" || r.Header.Get("X-Check") != "1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	backend := BackendPort{Name: "http", URL: downstreamURL, HealthCheckEndpoint: "/status"}
+	if err := runHealthCheck(t, backend); err == nil {
+		t.Error("Expected a 404 to be unhealthy")
+	}
+
+	backend.HealthCheck.Host = "status.internal"
+	backend.HealthCheck.Headers = map[string]string{"X-Check": "1"}
+	if err := runHealthCheck(t, backend); err != nil {
+		t.Errorf("Expected healthy, got %v", err)
+	}
+
+	backend.HealthCheck.ExpectedStatus = []int{200}
+	if err := runHealthCheck(t, backend); err == nil {
+		t.Error("Expected a 204 to be unhealthy when only 200 is expected")
+	}
+}
+
+func TestHTTPHealthCheckBodyRegex(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"degraded"}`))
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	backend := BackendPort{Name: "http", URL: downstreamURL}
+	backend.HealthCheck.BodyRegex = `"status":"ok"`
+	if err := runHealthCheck(t, backend); err == nil {
+		t.Error("Expected a non-matching body to be unhealthy")
+	}
+
+	backend.HealthCheck.BodyRegex = `"status":"(ok|degraded)"`
+	if err := runHealthCheck(t, backend); err != nil {
+		t.Errorf("Expected healthy, got %v", err)
+	}
+
+	backend.HealthCheck.BodyRegex = `(`
+	if _, err := NewHealthChecker(backend); err == nil {
+		t.Error("Expected an invalid regex to be rejected")
+	}
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := BackendPort{Name: "tcp", Address: listener.Addr().String()}
+	backend.HealthCheck.Type = HealthCheckTCP
+	if err := runHealthCheck(t, backend); err != nil {
+		t.Errorf("Expected healthy, got %v", err)
+	}
+
+	listener.Close()
+	if err := runHealthCheck(t, backend); err == nil {
+		t.Error("Expected a closed port to be unhealthy")
+	}
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("cache", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	backend := BackendPort{Name: "grpc", Address: listener.Addr().String()}
+	backend.HealthCheck.Type = HealthCheckGRPC
+	if err := runHealthCheck(t, backend); err != nil {
+		t.Errorf("Expected healthy, got %v", err)
+	}
+
+	backend.HealthCheck.Service = "cache"
+	if err := runHealthCheck(t, backend); err == nil {
+		t.Error("Expected a NOT_SERVING service to be unhealthy")
+	}
+}
+
+func TestExecHealthCheck(t *testing.T) {
+	backend := BackendPort{Name: "exec"}
+	backend.HealthCheck.Type = HealthCheckExec
+	if _, err := NewHealthChecker(backend); err == nil {
+		t.Error("Expected an exec check without a command to be rejected")
+	}
+
+	backend.HealthCheck.Command = []string{"true"}
+	if err := runHealthCheck(t, backend); err != nil {
+		t.Errorf("Expected healthy, got %v", err)
+	}
+
+	backend.HealthCheck.Command = []string{"sh", "-c", "echo down; exit 1"}
+	if err := runHealthCheck(t, backend); err == nil || err.Error() != "exit status 1: down" {
+		t.Errorf("Expected the command output in the error, got %v", err)
+	}
+
+	backend.HealthCheck.Command = []string{"sleep", "5"}
+	if err := runHealthCheck(t, backend); err == nil {
+		t.Error("Expected a command exceeding its timeout to be unhealthy")
+	}
+}
@@ -1,105 +1,535 @@
 package healthmonitor
 
 import (
+	"context"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
+	"log"
+	"math"
+	"reflect"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// HealthState is the health of a single backend
+type HealthState int
+
+// States a backend moves between. Unhealthy and draining backends receive no
+// new requests and count against min_alive
+const (
+	// StateUnknown is the state of a backend that has not been checked yet,
+	// it receives requests until its first check fails
+	StateUnknown HealthState = iota
+	StateHealthy
+	StateUnhealthy
+	// StateDraining backends are taken out of rotation regardless of their
+	// health check results, so that in-flight requests can finish
+	StateDraining
+)
+
+func (state HealthState) String() string {
+	switch state {
+	case StateUnknown:
+		return "unknown"
+	case StateHealthy:
+		return "healthy"
+	case StateUnhealthy:
+		return "unhealthy"
+	case StateDraining:
+		return "draining"
+	}
+	return fmt.Sprintf("HealthState(%d)", int(state))
+}
+
+func (state HealthState) isDown() bool {
+	return state == StateUnhealthy || state == StateDraining
+}
+
+// poolHealth counts the unhealthy backends of a pool. A pool is unhealthy
+// once numUnhealthy reaches threshold
+type poolHealth struct {
+	numUnhealthy uint32
+	threshold    uint32
+	labels       prometheus.Labels
+}
+
+func (pool *poolHealth) isUnhealthy() bool {
+	return atomic.LoadUint32(&pool.numUnhealthy) >= atomic.LoadUint32(&pool.threshold)
+}
+
 // HealthMonitor is responsible for monitoring and
 // reporting the health of the downstream ports
 type HealthMonitor struct {
-	numUnhealthy uint32
-	threshold    uint32
-	client       http.Client
-	proxy        *ProxyServer
-	backends     []BackendPort
-	metrics      HealthMonitorMetrics
-	serverLabel  prometheus.Labels
+	// poolHealth is the health of the default pool, which decides whether
+	// the server is up
+	poolHealth
+	proxy       *ProxyServer
+	metrics     HealthMonitorMetrics
+	serverLabel prometheus.Labels
+	outliers    *outlierDetector
+	wg          sync.WaitGroup
+	started     time.Time
+
+	// mu guards everything below as well as the state of each check, so a
+	// reload cannot interleave with a backend changing state
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	backends []BackendPort
+	checks   map[string]*backendCheck
+	// pools are the named pools, which answer 503 while unhealthy instead
+	// of taking the server down
+	pools          map[string]*poolHealth
+	configVersion  string
+	configLoadedAt time.Time
+}
+
+// backendCheck is the health state machine of a single backend
+type backendCheck struct {
+	backend   BackendPort
+	checker   HealthChecker
+	state     HealthState
+	successes int
+	failures  int
+	// ejected is set by outlier detection, independently of the state
+	ejected bool
+	// forced is set when the state was forced through the admin API, health
+	// checks then leave the state alone until it is cleared
+	forced bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	// trigger runs the next check right away
+	trigger chan struct{}
+	// lastCheck is when the last check finished, lastError its error if any
+	lastCheck time.Time
+	lastError string
+}
+
+// inRotation returns true if the load balancer should route to the backend
+func (check *backendCheck) inRotation() bool {
+	return !check.state.isDown() && !check.ejected
 }
 
-// NewHealthMonitor makes a HealthMonitor and returns it
+func newBackendCheck(backend BackendPort) *backendCheck {
+	checker, err := NewHealthChecker(backend)
+	if err != nil {
+		log.Printf("Invalid health check for backend %v: %v\n", backend.Name, err)
+		checker = &errorHealthChecker{err: err}
+	}
+	return &backendCheck{backend: backend, checker: checker, trigger: make(chan struct{}, 1)}
+}
+
+// NewHealthMonitor makes a HealthMonitor and returns it, its metrics are
+// registered along with those of proxy
 func NewHealthMonitor(config *Config, proxy *ProxyServer) *HealthMonitor {
 	serverLabel := prometheus.Labels{"server": config.Proxy.Name}
-	metrics := NewHealthMonitorMetrics()
-	metrics.status.With(serverLabel).Inc()
+	metrics := proxy.factory.newHealthMonitorMetrics()
+
+	checks := make(map[string]*backendCheck, len(config.Backend))
+	for _, backend := range config.Backend {
+		checks[backend.Name] = newBackendCheck(backend)
+		metrics.weight.With(prometheus.Labels{"server": config.Proxy.Name, "backend": backend.Name}).Set(float64(backend.Weight))
+	}
 
-	return &HealthMonitor{
-		numUnhealthy: 0,
-		threshold:    uint32(len(config.Backend) - config.Proxy.MinAlive), //should add an assert that this is greater than or equal to zero
-		proxy:        proxy,
-		backends:     config.Backend,
-		client:       http.Client{Timeout: time.Second},
-		metrics:      metrics,
-		serverLabel:  serverLabel,
+	hm := &HealthMonitor{
+		proxy:       proxy,
+		backends:    config.Backend,
+		checks:      checks,
+		metrics:     metrics,
+		serverLabel: serverLabel,
+		pools:       make(map[string]*poolHealth),
+		started:     time.Now(),
+		// the version may be empty for configs that were not parsed
+		configVersion:  config.Version,
+		configLoadedAt: time.Now(),
 	}
+	hm.poolHealth.labels = hm.poolLabels(DefaultPool)
+	thresholds := poolThresholds(config)
+	for name, threshold := range thresholds {
+		pool := hm.pool(name)
+		pool.threshold = threshold
+		metrics.status.With(pool.labels).Set(boolToFloat(!pool.isUnhealthy()))
+	}
+	hm.outliers = newOutlierDetector(hm, config.Proxy.OutlierDetection, config.Backend)
+	proxy.ph.outliers = hm.outliers
+	proxy.monitor = hm
+	return hm
 }
 
-// IsUnhealthy returns true if the server has more unhealthy downstreams
-// than the threshold value
+// IsUnhealthy returns true if the default pool of the server has more
+// unhealthy downstreams than the threshold value
 func (hm *HealthMonitor) IsUnhealthy() bool {
-	return atomic.LoadUint32(&hm.numUnhealthy) >= hm.threshold
+	return hm.poolHealth.isUnhealthy()
 }
 
-// ConfirmHealth starts the health check loop
-func (hm *HealthMonitor) ConfirmHealth(id uint16) {
-	for {
-		if !hm.checkHealth(id) {
-			hm.incUnhealthy(id)
-			hm.recoverHealth(id)
+func (hm *HealthMonitor) poolLabels(name string) prometheus.Labels {
+	return prometheus.Labels{"server": hm.serverLabel["server"], "pool": name}
+}
+
+func (hm *HealthMonitor) backendLabels(name string) prometheus.Labels {
+	return prometheus.Labels{"server": hm.serverLabel["server"], "backend": name}
+}
+
+// pool returns the health of the named pool, creating it for pools added by
+// a reload. It must be called with hm.mu held, except from NewHealthMonitor
+func (hm *HealthMonitor) pool(name string) *poolHealth {
+	if name == DefaultPool {
+		return &hm.poolHealth
+	}
+	pool, ok := hm.pools[name]
+	if !ok {
+		pool = &poolHealth{labels: hm.poolLabels(name)}
+		hm.pools[name] = pool
+	}
+	return pool
+}
+
+// poolThresholds returns the number of unhealthy backends that makes each
+// pool unhealthy. Pools without backends are never unhealthy, so that a
+// default pool left empty by routing does not keep the server down
+func poolThresholds(config *Config) map[string]uint32 {
+	sizes := make(map[string]int)
+	for _, backend := range config.Backend {
+		sizes[backend.poolName()]++
+	}
+	thresholds := make(map[string]uint32)
+	for name, pool := range config.poolConfigs() {
+		thresholds[name] = uint32(sizes[name] - pool.MinAlive)
+		if sizes[name] == 0 {
+			thresholds[name] = math.MaxUint32
 		}
-		time.Sleep(hm.backends[id].HealthCheckInterval)
 	}
+	return thresholds
 }
 
-func (hm *HealthMonitor) recoverHealth(id uint16) {
-	for {
-		if hm.checkHealth(id) {
-			hm.decUnhealthy(id)
-			hm.ConfirmHealth(id)
+// Start launches the health check loop of every backend. The loops run until
+// ctx is done or Stop is called
+func (hm *HealthMonitor) Start(ctx context.Context) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	if hm.ctx != nil {
+		return
+	}
+	hm.ctx, hm.cancel = context.WithCancel(ctx)
+	for _, check := range hm.checks {
+		hm.startCheck(check)
+	}
+	hm.wg.Add(1)
+	go func() {
+		defer hm.wg.Done()
+		hm.outliers.run(hm.ctx)
+	}()
+}
+
+// Stop stops every health check loop and waits for them to return
+func (hm *HealthMonitor) Stop() {
+	hm.mu.Lock()
+	if hm.cancel != nil {
+		hm.cancel()
+	}
+	hm.mu.Unlock()
+	hm.wg.Wait()
+}
+
+// startCheck must be called with hm.mu held. The timeout and interval are
+// read here because Reload may replace check.backend while the check runs,
+// sameHealthCheck makes sure they stay the same
+func (hm *HealthMonitor) startCheck(check *backendCheck) {
+	check.ctx, check.cancel = context.WithCancel(hm.ctx)
+	timeout := check.backend.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	interval := check.backend.HealthCheckInterval
+	hm.wg.Add(1)
+	go func() {
+		defer hm.wg.Done()
+		hm.runCheck(check, timeout, interval)
+	}()
+}
+
+// SetDraining takes the named backend out of rotation, or puts it back in
+// with an unknown state so the next health check decides. Either way it
+// replaces a state forced with SetHealthy
+func (hm *HealthMonitor) SetDraining(name string, draining bool) error {
+	hm.mu.Lock()
+	check, ok := hm.checks[name]
+	if !ok {
+		hm.mu.Unlock()
+		return fmt.Errorf("Unknown backend: %q", name)
+	}
+	check.forced = false
+	next := check.state
+	if draining {
+		next = StateDraining
+	} else if check.state == StateDraining {
+		next = StateUnknown
+		check.successes, check.failures = 0, 0
+	}
+	transition := hm.setState(check, next)
+	hm.mu.Unlock()
+
+	hm.applyTransition(transition)
+	return nil
+}
+
+// setEjected takes the named backend out of rotation or puts it back in on
+// behalf of outlier detection. Ejections do not count against min_alive
+func (hm *HealthMonitor) setEjected(name string, ejected bool) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	check, ok := hm.checks[name]
+	if !ok || check.ejected == ejected {
+		return
+	}
+	check.ejected = ejected
+	hm.metrics.ejected.With(hm.backendLabels(name)).Set(boolToFloat(ejected))
+	hm.proxy.ph.setHealth(name, check.inRotation())
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Reload applies a new config to the health monitor and its proxy server.
+// Health checks are started for added backends and stopped for removed ones,
+// while backends whose config did not change keep their health state.
+// Requests already in flight finish on the backend they were routed to
+func (hm *HealthMonitor) Reload(config *Config) {
+	// the proxy server could not build pools with these backends, so the
+	// whole config is rejected rather than applied halfway
+	for _, backend := range config.Backend {
+		if _, err := backend.clientTLSConfig(); err != nil {
+			log.Printf("Invalid tls config for backend %v, keeping the previous config: %v\n", backend.Name, err)
+			return
+		}
+	}
+
+	hm.mu.Lock()
+	wasUnhealthy := hm.IsUnhealthy()
+
+	checks := make(map[string]*backendCheck, len(config.Backend))
+	ejected := hm.outliers.reload(config.Proxy.OutlierDetection, config.Backend)
+	var added []*backendCheck
+	numUnhealthy := make(map[string]uint32)
+	var unhealthy []string
+	for _, backend := range config.Backend {
+		check, ok := hm.checks[backend.Name]
+		if ok && sameHealthCheck(check.backend, backend) {
+			delete(hm.checks, backend.Name)
+			// the pool may have changed
+			check.backend = backend
+			check.forced = false
+			if check.state.isDown() {
+				numUnhealthy[backend.poolName()]++
+			}
+		} else {
+			check = newBackendCheck(backend)
+			added = append(added, check)
+		}
+		check.ejected = ejected[backend.Name]
+		hm.metrics.weight.With(hm.backendLabels(backend.Name)).Set(float64(backend.Weight))
+		if !check.inRotation() {
+			unhealthy = append(unhealthy, backend.Name)
+		}
+		checks[backend.Name] = check
+	}
+
+	// whatever is left over was removed or changed
+	for _, check := range hm.checks {
+		if check.cancel != nil {
+			check.cancel()
 		}
-		time.Sleep(hm.backends[id].HealthCheckInterval)
+	}
+
+	hm.checks = checks
+	hm.backends = config.Backend
+	hm.configVersion, hm.configLoadedAt = config.Version, time.Now()
+	thresholds := poolThresholds(config)
+	for name := range hm.pools {
+		if _, ok := thresholds[name]; !ok {
+			hm.metrics.status.Delete(hm.pools[name].labels)
+			hm.metrics.numUnhealthyPorts.Delete(hm.pools[name].labels)
+			delete(hm.pools, name)
+		}
+	}
+	var downPools []string
+	for name, threshold := range thresholds {
+		pool := hm.pool(name)
+		atomic.StoreUint32(&pool.threshold, threshold)
+		atomic.StoreUint32(&pool.numUnhealthy, numUnhealthy[name])
+		hm.metrics.numUnhealthyPorts.With(pool.labels).Set(float64(numUnhealthy[name]))
+		if name == DefaultPool {
+			continue
+		}
+		hm.metrics.status.With(pool.labels).Set(boolToFloat(!pool.isUnhealthy()))
+		if pool.isUnhealthy() {
+			downPools = append(downPools, name)
+		}
+	}
+	hm.proxy.reload(config, unhealthy, downPools)
+	if hm.ctx != nil {
+		for _, check := range added {
+			hm.startCheck(check)
+		}
+	}
+	isUnhealthy := hm.IsUnhealthy()
+	hm.mu.Unlock()
+
+	if isUnhealthy && !wasUnhealthy {
+		hm.metrics.status.With(hm.poolHealth.labels).Set(0)
+		hm.applyTransition(serverDown)
+	} else if !isUnhealthy && wasUnhealthy {
+		hm.metrics.status.With(hm.poolHealth.labels).Set(1)
+		hm.applyTransition(serverUp)
 	}
 }
 
-func (hm *HealthMonitor) incUnhealthy(id uint16) {
-	if atomic.AddUint32(&hm.numUnhealthy, uint32(1)) == hm.threshold {
-		// want to execute this right away
-		hm.proxy.stop()
-		hm.metrics.status.With(hm.serverLabel).Dec()
+// sameHealthCheck returns true if a backend changed in a way that does not
+// require restarting its health check
+func sameHealthCheck(a, b BackendPort) bool {
+	a.Weight, b.Weight = 0, 0
+	a.Pool, b.Pool = "", ""
+	a.Transport, b.Transport = TransportConfig{}, TransportConfig{}
+	return reflect.DeepEqual(a, b)
+}
+
+func (hm *HealthMonitor) runCheck(check *backendCheck, timeout, interval time.Duration) {
+	if closer, ok := check.checker.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-check.ctx.Done():
+			return
+		case <-timer.C:
+		case <-check.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		ctx, cancel := context.WithTimeout(check.ctx, timeout)
+		err := check.checker.Check(ctx)
+		cancel()
+		hm.mu.Lock()
+		check.lastCheck, check.lastError = time.Now(), ""
+		if err != nil {
+			check.lastError = err.Error()
+		}
+		hm.mu.Unlock()
+		hm.observe(check, err == nil)
+		timer.Reset(interval)
 	}
-	hm.proxy.ph.lb.MarkUnhealthy(id)
-	hm.metrics.numUnhealthyPorts.With(hm.serverLabel).Inc()
 }
 
-func (hm *HealthMonitor) decUnhealthy(id uint16) {
-	if atomic.AddUint32(&hm.numUnhealthy, ^uint32(0)) == hm.threshold-1 {
-		hm.metrics.status.With(hm.serverLabel).Inc()
+// observe feeds a health check result into the state machine of a backend.
+// A backend goes down after Fall consecutive failures and comes back up
+// after Rise consecutive successes
+func (hm *HealthMonitor) observe(check *backendCheck, healthy bool) {
+	hm.mu.Lock()
+	if check.ctx != nil && check.ctx.Err() != nil {
+		// the check was stopped while it was in flight
+		hm.mu.Unlock()
+		return
+	}
+
+	next := check.state
+	if healthy {
+		check.failures = 0
+		check.successes++
+		if check.state == StateUnknown || (check.state == StateUnhealthy && check.successes >= check.backend.Rise) {
+			next = StateHealthy
+		}
+	} else {
+		check.successes = 0
+		check.failures++
+		if (check.state == StateUnknown || check.state == StateHealthy) && check.failures >= check.backend.Fall {
+			next = StateUnhealthy
+		}
+	}
+	if check.forced {
+		next = check.state
 	}
-	hm.proxy.ph.lb.MarkHealthy(id)
-	hm.metrics.numUnhealthyPorts.With(hm.serverLabel).Dec()
+	transition := hm.setState(check, next)
+	hm.mu.Unlock()
+
+	hm.applyTransition(transition)
 }
 
-func (hm *HealthMonitor) checkHealth(id uint16) bool {
-	endpoint := hm.backends[id].URL.String() + hm.backends[id].HealthCheckEndpoint
-	req, err := http.NewRequest("GET", endpoint, nil)
-	req.Close = true
-	response, err := hm.client.Do(req)
-	if err != nil {
-		return false
+// serverTransition is the effect of a backend state change on the server
+type serverTransition int
+
+const (
+	serverUnchanged serverTransition = iota
+	// serverDown means the server just became unhealthy
+	serverDown
+	// serverUp means the server just recovered
+	serverUp
+)
+
+// applyTransition shuts down or drains the proxy when the server becomes
+// unhealthy, and resumes a draining proxy or wakes up the loop restarting a
+// shut down one once it recovers. It must be called without hm.mu held since
+// stopping waits for in-flight requests
+func (hm *HealthMonitor) applyTransition(transition serverTransition) {
+	switch transition {
+	case serverDown:
+		// want to execute this right away
+		hm.proxy.stop()
+	case serverUp:
+		hm.proxy.resume()
+		hm.proxy.notify()
 	}
+}
 
-	responseVal := (response.StatusCode - 400) / 100
-	if responseVal >= 0 {
-		return false
+// setState moves a check to the next state, updating the load balancer and
+// metrics. It must be called with hm.mu held, the caller should apply the
+// returned transition once it is released. Named pools crossing their
+// threshold are marked down or up right away, only the default pool
+// results in a server transition
+func (hm *HealthMonitor) setState(check *backendCheck, next HealthState) serverTransition {
+	wasDown := check.state.isDown()
+	check.state = next
+	if wasDown == next.isDown() {
+		return serverUnchanged
 	}
 
-	io.Copy(ioutil.Discard, response.Body)
-	response.Body.Close()
+	name := check.backend.poolName()
+	pool := hm.pool(name)
+	threshold := atomic.LoadUint32(&pool.threshold)
+	hm.proxy.ph.setHealth(check.backend.Name, check.inRotation())
+	transition := serverUnchanged
+	if next.isDown() {
+		hm.metrics.numUnhealthyPorts.With(pool.labels).Inc()
+		if atomic.AddUint32(&pool.numUnhealthy, uint32(1)) == threshold {
+			hm.metrics.status.With(pool.labels).Set(0)
+			transition = serverDown
+		}
+	} else {
+		hm.metrics.numUnhealthyPorts.With(pool.labels).Dec()
+		if atomic.AddUint32(&pool.numUnhealthy, ^uint32(0)) == threshold-1 {
+			hm.metrics.status.With(pool.labels).Set(1)
+			transition = serverUp
+		}
+	}
 
-	return true
+	if name == DefaultPool || transition == serverUnchanged {
+		return transition
+	}
+	if transition == serverDown {
+		log.Printf("Pool %v is unhealthy, refusing its requests\n", name)
+	} else {
+		log.Printf("Pool %v has recovered\n", name)
+	}
+	hm.proxy.ph.setPoolDown(name, transition == serverDown)
+	return serverUnchanged
 }
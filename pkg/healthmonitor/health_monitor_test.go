@@ -1 +1,237 @@
 package healthmonitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wish/tcp-mux-proxy/pkg/loadbalancer"
+)
+
+func TestHealthMonitorReload(t *testing.T) {
+	configLocation := "config.sample.yaml"
+	config, err := ParseConfig(configLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	kept := healthMonitor.checks["server_1"]
+	healthMonitor.observe(kept, false)
+
+	reloaded := config
+	reloaded.Backend = append([]BackendPort{}, config.Backend[:4]...)
+	reloaded.Backend = append(reloaded.Backend, BackendPort{
+		Name:                "server_6",
+		Host:                "http://localhost",
+		Port:                3005,
+		HealthCheckEndpoint: "/status",
+		URL:                 config.Backend[0].URL,
+	})
+	reloaded.Backend[1].Port = 4001
+	reloaded.Backend[2].Weight = 5
+	weighted := healthMonitor.checks["server_3"]
+	healthMonitor.Reload(&reloaded)
+
+	if healthMonitor.checks["server_1"] != kept {
+		t.Error("Unchanged backend should keep its health check")
+	}
+	if kept.state != StateUnhealthy {
+		t.Error("Unchanged backend should keep its health state")
+	}
+	if _, ok := healthMonitor.checks["server_5"]; ok {
+		t.Error("Removed backend should have its health check removed")
+	}
+	if healthMonitor.checks["server_2"].backend.Port != 4001 {
+		t.Error("Changed backend should have its health check restarted")
+	}
+	if healthMonitor.checks["server_3"] != weighted {
+		t.Error("Reweighted backend should keep its health check")
+	}
+
+	pool := proxy.ph.getPool()
+	if len(pool.backends) != 5 || pool.backends[4].Name != "server_6" {
+		t.Errorf("Backend pool was not replaced: %v", pool.backends)
+	}
+
+	lb := pool.lb.(loadbalancer.WeightedLoadBalancer)
+	if weight := lb.Weight(pool.ids["server_3"]); weight != 5 {
+		t.Errorf("Expected weight 5, got %v", weight)
+	}
+	if err := proxy.SetWeight("server_3", 2); err != nil {
+		t.Fatal(err)
+	}
+	if weight := lb.Weight(pool.ids["server_3"]); weight != 2 {
+		t.Errorf("Expected weight 2, got %v", weight)
+	}
+	if err := proxy.SetWeight("server_5", 2); err == nil {
+		t.Error("Expected an error for a removed backend")
+	}
+
+	// the weight set at runtime survives a reload until the config changes it
+	healthMonitor.Reload(&reloaded)
+	pool = proxy.ph.getPool()
+	if weight := pool.lb.(loadbalancer.WeightedLoadBalancer).Weight(pool.ids["server_3"]); weight != 2 {
+		t.Errorf("Expected the weight of 2 to be kept, got %v", weight)
+	}
+	reloaded.Backend[2].Weight = 7
+	healthMonitor.Reload(&reloaded)
+	pool = proxy.ph.getPool()
+	if weight := pool.lb.(loadbalancer.WeightedLoadBalancer).Weight(pool.ids["server_3"]); weight != 7 {
+		t.Errorf("Expected the configured weight 7, got %v", weight)
+	}
+}
+
+func TestHealthStateMachine(t *testing.T) {
+	var config Config
+	config.Proxy.Name = "state_machine_test"
+	config.Proxy.MinAlive = 1
+	for i := 0; i < 3; i++ {
+		config.Backend = append(config.Backend, BackendPort{Name: "server_" + strconv.Itoa(i), Rise: 2, Fall: 3})
+	}
+
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	check := healthMonitor.checks["server_0"]
+
+	steps := []struct {
+		healthy bool
+		state   HealthState
+	}{
+		{true, StateHealthy},
+		{false, StateHealthy},
+		{false, StateHealthy},
+		{false, StateUnhealthy},
+		{true, StateUnhealthy},
+		{false, StateUnhealthy},
+		{true, StateUnhealthy},
+		{true, StateHealthy},
+	}
+	for i, step := range steps {
+		healthMonitor.observe(check, step.healthy)
+		if check.state != step.state {
+			t.Fatalf("Step %v: expected state %v, got %v", i, step.state, check.state)
+		}
+	}
+	if atomic.LoadUint32(&healthMonitor.numUnhealthy) != 0 {
+		t.Errorf("Expected no unhealthy backends, got %v", healthMonitor.numUnhealthy)
+	}
+
+	if err := healthMonitor.SetDraining("server_1", true); err != nil {
+		t.Fatal(err)
+	}
+	healthMonitor.observe(healthMonitor.checks["server_1"], true)
+	if state := healthMonitor.checks["server_1"].state; state != StateDraining {
+		t.Errorf("Draining backend should ignore health checks, got %v", state)
+	}
+	if atomic.LoadUint32(&healthMonitor.numUnhealthy) != 1 {
+		t.Errorf("Expected draining backend to count as unhealthy")
+	}
+	if err := healthMonitor.SetDraining("server_1", false); err != nil {
+		t.Fatal(err)
+	}
+	if state := healthMonitor.checks["server_1"].state; state != StateUnknown {
+		t.Errorf("Expected state %v after draining, got %v", StateUnknown, state)
+	}
+	if err := healthMonitor.SetDraining("missing", true); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestHealthMonitorStop(t *testing.T) {
+	var healthy int32 = 1
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.Name = "stop_test"
+	config.Backend = []BackendPort{{
+		Name:                "server_1",
+		HealthCheckInterval: 10 * time.Millisecond,
+		Rise:                1,
+		Fall:                1,
+		URL:                 downstreamURL,
+	}}
+
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	healthMonitor.Start(context.Background())
+
+	waitForState := func(state HealthState) {
+		for i := 0; i < 100; i++ {
+			healthMonitor.mu.Lock()
+			current := healthMonitor.checks["server_1"].state
+			healthMonitor.mu.Unlock()
+			if current == state {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Backend never became %v", state)
+	}
+
+	waitForState(StateHealthy)
+	atomic.StoreInt32(&healthy, 0)
+	waitForState(StateUnhealthy)
+	atomic.StoreInt32(&healthy, 1)
+	waitForState(StateHealthy)
+
+	done := make(chan struct{})
+	go func() {
+		healthMonitor.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
+
+func TestHealthMonitorReloadWhileChecking(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.Name = "reload_race_test"
+	config.Backend = []BackendPort{{
+		Name:                "server_1",
+		HealthCheckInterval: time.Millisecond,
+		Rise:                1,
+		Fall:                1,
+		Weight:              1,
+		URL:                 downstreamURL,
+	}}
+
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	healthMonitor.Start(context.Background())
+	defer healthMonitor.Stop()
+
+	check := healthMonitor.checks["server_1"]
+	reloaded := config
+	for i := 0; i < 200; i++ {
+		reloaded.Backend = []BackendPort{config.Backend[0]}
+		reloaded.Backend[0].Weight = uint32(i%5 + 1)
+		healthMonitor.Reload(&reloaded)
+		time.Sleep(100 * time.Microsecond)
+	}
+
+	healthMonitor.mu.Lock()
+	defer healthMonitor.mu.Unlock()
+	if healthMonitor.checks["server_1"] != check {
+		t.Error("Reweighted backend should keep its health check")
+	}
+}
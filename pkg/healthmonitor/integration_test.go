@@ -26,10 +26,11 @@ func TestSystemBasic(t *testing.T) {
 	}
 	rand.Seed(time.Now().UnixNano())
 
-	// Initialize proxy and health monitor
-	proxy := NewProxyServer(&config)
-	healthMonitor := NewHealthMonitor(&config, proxy)
-	go MetricsServer(config.Proxy.MetricsPort)
+	// Initialize the proxy, which serves the metrics as well
+	proxy, err := New(&config)
+	if err != nil {
+		log.Fatalf("Could not create proxy: %v\n", err)
+	}
 
 	for _, backend := range config.Backend {
 		go runMockDownstream(":" + strconv.Itoa(backend.Port))
@@ -39,28 +40,14 @@ func TestSystemBasic(t *testing.T) {
 		}(backend.Port)
 	}
 
-	// we can launch the health checks before starting the proxy server
-	for id := range config.Backend {
-		go healthMonitor.ConfirmHealth(uint16(id))
-	}
-
 	go runMockUpstream("http://localhost" + config.Proxy.Bind)
 	go func() {
 		time.Sleep(time.Second * 30)
 		runMockUpstream("http://localhost" + config.Proxy.Bind)
 	}()
 
-	// Main application loop
-	for {
-		err := proxy.Start()
-		if err != nil {
-			log.Fatalf("Could not start proxy: %v\n", err)
-			panic(err)
-		}
-
-		for healthMonitor.IsUnhealthy() || proxy.IsInShutdown() {
-			time.Sleep(config.Proxy.RecoverySleepTime)
-		}
+	if err := proxy.Run(context.Background()); err != nil {
+		t.Fatal(err)
 	}
 }
 
@@ -0,0 +1,301 @@
+package healthmonitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Proxy runs the frontends of a config along with their health monitors, the
+// metrics server and the admin API. A frontend shut down by its health
+// monitor is started again as soon as the monitor brings it back up
+type Proxy struct {
+	frontends []*frontend
+	monitors  map[string]*HealthMonitor
+	// servers are the metrics and admin servers, by name
+	servers map[string]*http.Server
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// frontend is a proxy server and its health monitor
+type frontend struct {
+	name    string
+	proxy   *ProxyServer
+	monitor *HealthMonitor
+	// recoverySleepTime is read at startup, changing it requires a restart
+	recoverySleepTime time.Duration
+}
+
+type proxyOptions struct {
+	metricsBind string
+	mux         *http.ServeMux
+	registerer  prometheus.Registerer
+	labels      prometheus.Labels
+}
+
+// Option configures a Proxy
+type Option func(*proxyOptions)
+
+// WithMetricsBind serves the metrics server on bind instead of the
+// metrics_server_port of the config. An empty bind disables the metrics
+// server, along with the admin API unless it has its own bind
+func WithMetricsBind(bind string) Option {
+	return func(options *proxyOptions) {
+		options.metricsBind = bind
+	}
+}
+
+// WithServeMux registers /metrics, the status endpoints and the admin API
+// without a bind of its own on mux instead of running a metrics server. The
+// paths must not be registered on mux already
+func WithServeMux(mux *http.ServeMux) Option {
+	return func(options *proxyOptions) {
+		options.mux = mux
+	}
+}
+
+// WithRegisterer registers the metrics on registerer instead of the default
+// prometheus registry. /metrics only serves them if registerer is also a
+// prometheus.Gatherer, like a *prometheus.Registry
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(options *proxyOptions) {
+		options.registerer = registerer
+	}
+}
+
+// WithLabels adds labels to every metric of the proxy, which tells apart the
+// metrics of several proxies registered on the same registerer
+func WithLabels(labels prometheus.Labels) Option {
+	return func(options *proxyOptions) {
+		options.labels = labels
+	}
+}
+
+// New builds a Proxy for a config returned by ParseConfig
+func New(config *Config, opts ...Option) (*Proxy, error) {
+	options := proxyOptions{metricsBind: config.Proxy.MetricsPort, registerer: prometheus.DefaultRegisterer}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	for _, name := range metricLabels {
+		if _, ok := options.labels[name]; ok {
+			return nil, fmt.Errorf("Label %q is used by the metrics already", name)
+		}
+	}
+	factory := metricsFactory{registerer: options.registerer, labels: options.labels}
+
+	frontends := config.FrontendConfigs()
+	p := &Proxy{
+		monitors: make(map[string]*HealthMonitor, len(frontends)),
+		servers:  make(map[string]*http.Server),
+	}
+	for i := range frontends {
+		frontendConfig := &frontends[i]
+		name := frontendConfig.Proxy.Name
+		if _, ok := p.monitors[name]; ok {
+			return nil, fmt.Errorf("Duplicate frontend name: %q", name)
+		}
+		proxy, err := newProxyServer(frontendConfig, factory)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config for frontend %v: %v", name, err)
+		}
+		monitor := NewHealthMonitor(frontendConfig, proxy)
+		p.frontends = append(p.frontends, &frontend{name: name, proxy: proxy, monitor: monitor, recoverySleepTime: frontendConfig.Proxy.RecoverySleepTime})
+		p.monitors[name] = monitor
+	}
+
+	metricsMux := options.mux
+	if metricsMux == nil && options.metricsBind != "" {
+		metricsMux = http.NewServeMux()
+		p.servers["metrics"] = &http.Server{Addr: options.metricsBind, Handler: metricsMux}
+	}
+	if metricsMux != nil {
+		handleMetrics(metricsMux, options.registerer, p.monitors)
+	}
+	if config.Admin.Enabled() {
+		handler, err := NewAdminHandler(config.Admin, p.monitors)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid admin config: %v", err)
+		}
+		if config.Admin.Bind != "" {
+			p.servers["admin"] = &http.Server{Addr: config.Admin.Bind, Handler: handler}
+		} else if metricsMux != nil {
+			metricsMux.Handle("/admin/", handler)
+		} else {
+			log.Println("The admin API has no bind and the metrics server is disabled, it will not be served")
+		}
+	}
+	return p, nil
+}
+
+// HealthMonitors returns the health monitors of the frontends by name
+func (p *Proxy) HealthMonitors() map[string]*HealthMonitor {
+	return p.monitors
+}
+
+// Run starts the health checks and servers and blocks until ctx is done,
+// Shutdown is called or one of the servers fails, whose error it returns.
+// Once ctx is done requests in flight are not waited for, Shutdown stops the
+// proxy gracefully instead. A Proxy can only be run once
+func (p *Proxy) Run(ctx context.Context) error {
+	p.mu.Lock()
+	if p.done != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("The proxy was already run")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	p.mu.Unlock()
+	defer close(p.done)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(p.frontends)+len(p.servers))
+	run := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	// we can launch the health checks before starting the proxy servers
+	for _, monitor := range p.monitors {
+		monitor.Start(ctx)
+	}
+	for name, server := range p.servers {
+		name, server := name, server
+		run(func() error {
+			log.Printf("Starting %v server\n", name)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				return fmt.Errorf("The %v server failed: %v", name, err)
+			}
+			return nil
+		})
+	}
+	for _, f := range p.frontends {
+		f := f
+		run(func() error { return f.run(ctx) })
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	// the context is done, so this does not wait for requests in flight
+	cancel()
+	p.stop(ctx)
+	wg.Wait()
+	return err
+}
+
+// Shutdown stops the proxy, waiting for requests in flight until ctx is done,
+// and then waits for Run to return
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	err := p.stop(ctx)
+	p.mu.Lock()
+	cancel, done := p.cancel, p.done
+	p.mu.Unlock()
+	if cancel == nil {
+		return err
+	}
+	cancel()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop shuts down every server and stops the health checks
+func (p *Proxy) stop(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(p.frontends)+len(p.servers))
+	shutdown := func(name string, f func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(ctx); err != nil {
+				errs <- fmt.Errorf("Could not shut down %v: %v", name, err)
+			}
+		}()
+	}
+	for _, f := range p.frontends {
+		shutdown("proxy "+f.name, f.proxy.Shutdown)
+	}
+	for name, server := range p.servers {
+		shutdown("the "+name+" server", server.Shutdown)
+	}
+	wg.Wait()
+	for _, monitor := range p.monitors {
+		monitor.Stop()
+	}
+	close(errs)
+	return <-errs
+}
+
+// Reload applies a new config to the running frontends. Frontends are matched
+// by name, adding or removing them requires a restart
+func (p *Proxy) Reload(config *Config) {
+	frontends := config.FrontendConfigs()
+	reloaded := make(map[string]bool, len(frontends))
+	for i := range frontends {
+		monitor, ok := p.monitors[frontends[i].Proxy.Name]
+		if !ok {
+			log.Printf("Adding frontend %v requires a restart and was not applied\n", frontends[i].Proxy.Name)
+			continue
+		}
+		monitor.Reload(&frontends[i])
+		reloaded[frontends[i].Proxy.Name] = true
+	}
+	for name := range p.monitors {
+		if !reloaded[name] {
+			log.Printf("Removing frontend %v requires a restart and was not applied\n", name)
+		}
+	}
+}
+
+// run is the main loop of a frontend, which starts its proxy server again
+// recoverySleepTime after its health monitor brings it back up
+func (f *frontend) run(ctx context.Context) error {
+	for {
+		if err := f.proxy.Start(); err != nil {
+			return fmt.Errorf("Could not start proxy %v: %v", f.name, err)
+		}
+		for f.monitor.IsUnhealthy() || f.proxy.IsInShutdown() {
+			if f.proxy.isClosed() {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-f.proxy.wake:
+			}
+			// back off so that a flapping frontend is not restarted right
+			// away, its health is checked again afterwards
+			if !f.monitor.IsUnhealthy() && f.recoverySleepTime > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(f.recoverySleepTime):
+				}
+			}
+		}
+		if ctx.Err() != nil || f.proxy.isClosed() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package healthmonitor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyLifecycle(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	// find a free port for the proxy
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := listener.Addr().String()
+	listener.Close()
+
+	checker := &switchChecker{healthy: 1}
+	var config Config
+	config.Proxy.Name = "lifecycle_test"
+	config.Proxy.Bind = bind
+	config.Proxy.MaxConn = 10
+	config.Proxy.ShutdownMode = ShutdownModeShutdown
+	config.Proxy.MetricsPort = "127.0.0.1:1"
+	config.Proxy.RecoverySleepTime = 100 * time.Millisecond
+	config.Backend = []BackendPort{{
+		Name:                "lifecycle_1",
+		URL:                 downstreamURL,
+		HealthCheckInterval: 10 * time.Millisecond,
+		Rise:                1,
+		Fall:                1,
+		HealthCheck:         HealthCheckConfig{Checker: checker},
+	}}
+	proxy, err := New(&config, WithMetricsBind(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- proxy.Run(context.Background()) }()
+
+	serving := func(expected bool) {
+		var err error
+		for i := 0; i < 200; i++ {
+			var response *http.Response
+			if response, err = http.Get("http://" + bind + "/"); err == nil {
+				response.Body.Close()
+			}
+			if (err == nil) == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected the proxy to be serving: %v, got %v", expected, err)
+	}
+
+	serving(true)
+	atomic.StoreInt32(&checker.healthy, 0)
+	serving(false)
+	// the frontend comes back up without being polled, once it backed off
+	recovered := time.Now()
+	atomic.StoreInt32(&checker.healthy, 1)
+	serving(true)
+	if elapsed := time.Since(recovered); elapsed < config.Proxy.RecoverySleepTime {
+		t.Errorf("Expected the frontend to be started again after %v, got %v", config.Proxy.RecoverySleepTime, elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected Run to return nil after Shutdown, got %v", err)
+	}
+	serving(false)
+	if err := proxy.Run(context.Background()); err == nil {
+		t.Error("Expected a proxy to only run once")
+	}
+}
+
+func TestProxyRunError(t *testing.T) {
+	// the proxy cannot listen on a port that is taken
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var config Config
+	config.Proxy.Name = "lifecycle_error_test"
+	config.Proxy.Bind = listener.Addr().String()
+	config.Backend = []BackendPort{{
+		Name:                "lifecycle_error_1",
+		URL:                 &url.URL{Scheme: "http", Host: "localhost:3000"},
+		HealthCheckInterval: time.Hour,
+		Rise:                1,
+		Fall:                1,
+		HealthCheck:         HealthCheckConfig{Checker: &switchChecker{healthy: 1}},
+	}}
+	proxy, err := New(&config, WithMetricsBind(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- proxy.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected Run to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once the proxy failed to start")
+	}
+}
@@ -0,0 +1,230 @@
+package healthmonitor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Server defaults, the timeouts the proxy used before they were configurable
+const (
+	defaultReadTimeout  = 5 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+	defaultIdleTimeout  = 60 * time.Second
+)
+
+var (
+	errBodyTooLarge = errors.New("Request body too large")
+	errReadTimeout  = errors.New("Timeout reading request body")
+)
+
+// ServerConfig tunes the HTTP server of the proxy. ReadHeaderTimeout defaults
+// to ReadTimeout and MaxHeaderBytes to the net/http default, a MaxBodySize of
+// zero does not limit request bodies. Overrides apply to the requests whose
+// path starts with their prefix, the longest prefix wins
+type ServerConfig struct {
+	ReadTimeout       time.Duration   `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration   `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration   `yaml:"write_timeout"`
+	IdleTimeout       time.Duration   `yaml:"idle_timeout"`
+	MaxHeaderBytes    int             `yaml:"max_header_bytes"`
+	MaxBodySize       int64           `yaml:"max_body_size"`
+	Overrides         []RouteOverride `yaml:"overrides"`
+}
+
+// RouteOverride changes the limits for a path prefix, fields left at zero
+// keep the server values. Since the server timeouts apply to whole
+// connections, they are raised to the longest override and the shorter
+// timeouts are enforced per request
+type RouteOverride struct {
+	PathPrefix   string        `yaml:"path_prefix"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	MaxBodySize  int64         `yaml:"max_body_size"`
+}
+
+func (config *ServerConfig) setDefaults() {
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = defaultReadTimeout
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = defaultWriteTimeout
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultIdleTimeout
+	}
+}
+
+func (config ServerConfig) validate() error {
+	for _, override := range config.Overrides {
+		if !strings.HasPrefix(override.PathPrefix, "/") {
+			return fmt.Errorf("Invalid override path_prefix: %q", override.PathPrefix)
+		}
+	}
+	return nil
+}
+
+// requestLimits are the limits that apply to a single request
+type requestLimits struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	maxBodySize  int64
+}
+
+// serverLimits resolves the limits of requests from a ServerConfig
+type serverLimits struct {
+	config ServerConfig
+	// readTimeout and writeTimeout are the connection timeouts, the
+	// longest of the server and its overrides
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	defaults     requestLimits
+	// overrides are sorted from the longest prefix to the shortest
+	overrides []RouteOverride
+}
+
+func newServerLimits(config ServerConfig) *serverLimits {
+	config.setDefaults()
+	limits := &serverLimits{
+		config:       config,
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+		defaults: requestLimits{
+			readTimeout:  config.ReadTimeout,
+			writeTimeout: config.WriteTimeout,
+			maxBodySize:  config.MaxBodySize,
+		},
+		overrides: append([]RouteOverride{}, config.Overrides...),
+	}
+	sort.SliceStable(limits.overrides, func(i, j int) bool {
+		return len(limits.overrides[i].PathPrefix) > len(limits.overrides[j].PathPrefix)
+	})
+	for _, override := range limits.overrides {
+		if override.ReadTimeout > limits.readTimeout {
+			limits.readTimeout = override.ReadTimeout
+		}
+		if override.WriteTimeout > limits.writeTimeout {
+			limits.writeTimeout = override.WriteTimeout
+		}
+	}
+	return limits
+}
+
+// forPath returns the limits of a request for path
+func (limits *serverLimits) forPath(path string) requestLimits {
+	for _, override := range limits.overrides {
+		if !strings.HasPrefix(path, override.PathPrefix) {
+			continue
+		}
+		requestLimits := limits.defaults
+		if override.ReadTimeout > 0 {
+			requestLimits.readTimeout = override.ReadTimeout
+		}
+		if override.WriteTimeout > 0 {
+			requestLimits.writeTimeout = override.WriteTimeout
+		}
+		if override.MaxBodySize > 0 {
+			requestLimits.maxBodySize = override.MaxBodySize
+		}
+		return requestLimits
+	}
+	return limits.defaults
+}
+
+// applyTo sets the connection limits on an http.Server
+func (limits *serverLimits) applyTo(server *http.Server) {
+	server.ReadTimeout = limits.readTimeout
+	server.ReadHeaderTimeout = limits.config.ReadHeaderTimeout
+	if server.ReadHeaderTimeout <= 0 {
+		// keep the header timeout from growing with the overrides
+		server.ReadHeaderTimeout = limits.config.ReadTimeout
+	}
+	server.WriteTimeout = limits.writeTimeout
+	server.IdleTimeout = limits.config.IdleTimeout
+	server.MaxHeaderBytes = limits.config.MaxHeaderBytes
+}
+
+func (ph *proxyHandler) setServerConfig(config ServerConfig) {
+	ph.limits.Store(newServerLimits(config))
+}
+
+func (ph *proxyHandler) getServerLimits() *serverLimits {
+	return ph.limits.Load().(*serverLimits)
+}
+
+// limitedBody fails reads past the size limit of a request, or after its
+// read deadline. A read that blocks is only interrupted by the connection
+// timeouts, so the deadline catches clients that trickle their body
+type limitedBody struct {
+	io.ReadCloser
+	// remaining is negative if there is no size limit
+	remaining int64
+	deadline  time.Time
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	if !body.deadline.IsZero() && time.Now().After(body.deadline) {
+		return 0, errReadTimeout
+	}
+	if body.remaining < 0 {
+		return body.ReadCloser.Read(p)
+	}
+	// read one byte more than allowed to tell a body that is exactly at
+	// the limit from one that is over it
+	if int64(len(p)) > body.remaining+1 {
+		p = p[:body.remaining+1]
+	}
+	n, err := body.ReadCloser.Read(p)
+	if int64(n) > body.remaining {
+		n = int(body.remaining)
+		body.remaining = 0
+		return n, errBodyTooLarge
+	}
+	body.remaining -= int64(n)
+	return n, err
+}
+
+// limitRequest applies limits to a request, it returns false if the request
+// was answered because its body is known to be too large
+func limitRequest(w http.ResponseWriter, r *http.Request, limits requestLimits, connReadTimeout time.Duration) bool {
+	if limits.maxBodySize > 0 && r.ContentLength > limits.maxBodySize {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	body := &limitedBody{ReadCloser: r.Body, remaining: -1}
+	if limits.maxBodySize > 0 {
+		body.remaining = limits.maxBodySize
+	}
+	if limits.readTimeout < connReadTimeout {
+		body.deadline = time.Now().Add(limits.readTimeout)
+	}
+	if body.remaining >= 0 || !body.deadline.IsZero() {
+		r.Body = body
+	}
+	return true
+}
+
+// proxyError answers requests that could not be proxied like the default
+// error handler of httputil.ReverseProxy, except for bodies over the limit
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errBodyTooLarge:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	case errReadTimeout:
+		w.WriteHeader(http.StatusRequestTimeout)
+	default:
+		log.Printf("http: proxy error: %v\n", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,95 @@
+package healthmonitor
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerLimits(t *testing.T) {
+	limits := newServerLimits(ServerConfig{
+		MaxBodySize: 10,
+		Overrides: []RouteOverride{
+			{PathPrefix: "/stream", WriteTimeout: time.Minute},
+			{PathPrefix: "/stream/upload", ReadTimeout: time.Hour, MaxBodySize: 100},
+		},
+	})
+	if limits.readTimeout != time.Hour || limits.writeTimeout != time.Minute {
+		t.Errorf("Expected the connection timeouts to be the longest, got %v and %v", limits.readTimeout, limits.writeTimeout)
+	}
+
+	for path, expected := range map[string]requestLimits{
+		"/":                 {readTimeout: defaultReadTimeout, writeTimeout: defaultWriteTimeout, maxBodySize: 10},
+		"/stream":           {readTimeout: defaultReadTimeout, writeTimeout: time.Minute, maxBodySize: 10},
+		"/stream/upload/1":  {readTimeout: time.Hour, writeTimeout: defaultWriteTimeout, maxBodySize: 100},
+		"/streaming/upload": {readTimeout: defaultReadTimeout, writeTimeout: time.Minute, maxBodySize: 10},
+	} {
+		if actual := limits.forPath(path); actual != expected {
+			t.Errorf("Expected %+v for %v, got %+v", expected, path, actual)
+		}
+	}
+
+	server := &http.Server{}
+	limits.applyTo(server)
+	if server.ReadHeaderTimeout != defaultReadTimeout || server.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("Expected the default header and idle timeouts, got %v and %v", server.ReadHeaderTimeout, server.IdleTimeout)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if strings.HasSuffix(r.URL.Path, "/slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "limits_test"
+	config.Proxy.Server = ServerConfig{
+		WriteTimeout: time.Second,
+		MaxBodySize:  10,
+		Overrides: []RouteOverride{
+			{PathPrefix: "/upload/", MaxBodySize: 100},
+			{PathPrefix: "/short/", WriteTimeout: 50 * time.Millisecond},
+		},
+	}
+	config.Backend = []BackendPort{{Name: "server_1", URL: downstreamURL}}
+	proxy := NewProxyServer(&config)
+
+	serve := func(path string, body string, chunked bool) int {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if chunked {
+			request.ContentLength = -1
+		}
+		recorder := httptest.NewRecorder()
+		proxy.ph.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	for _, test := range []struct {
+		path     string
+		body     string
+		chunked  bool
+		expected int
+	}{
+		{"/", "small", false, http.StatusOK},
+		{"/", "more than ten bytes", false, http.StatusRequestEntityTooLarge},
+		{"/", "more than ten bytes", true, http.StatusRequestEntityTooLarge},
+		{"/", "exactly 10", true, http.StatusOK},
+		{"/upload/", "more than ten bytes", true, http.StatusOK},
+		{"/slow", "", false, http.StatusOK},
+		{"/short/slow", "", false, http.StatusBadGateway},
+	} {
+		if code := serve(test.path, test.body, test.chunked); code != test.expected {
+			t.Errorf("Expected status %v for %v with body %q, got %v", test.expected, test.path, test.body, code)
+		}
+	}
+}
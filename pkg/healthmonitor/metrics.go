@@ -1,7 +1,7 @@
 package healthmonitor
 
 import (
-	"io"
+	"fmt"
 	"log"
 	"net/http"
 
@@ -9,32 +9,98 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// MetricsServer launches the prometheus metrics server
+// MetricsServer launches the prometheus metrics server and panics if it fails.
+// It serves no status of the frontends, ServeMetrics or New do
 func MetricsServer(bind string) {
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		io.WriteString(w, `{"alive":true}`)
-	}))
+	if err := ServeMetrics(bind, nil); err != nil {
+		panic(err)
+	}
+}
 
+// ServeMetrics launches the prometheus metrics server, which also serves the
+// status endpoints of NewStatusMux for the health monitors of the frontends
+func ServeMetrics(bind string, monitors map[string]*HealthMonitor) error {
 	log.Println("Starting metrics server")
-	if err := http.ListenAndServe(bind, nil); err != nil {
-		panic(err)
+	mux := http.NewServeMux()
+	handleMetrics(mux, prometheus.DefaultRegisterer, monitors)
+	return http.ListenAndServe(bind, mux)
+}
+
+// handleMetrics registers /metrics and the status endpoints on mux. /metrics
+// is only registered if registerer can be gathered from, like a
+// *prometheus.Registry
+func handleMetrics(mux *http.ServeMux, registerer prometheus.Registerer, monitors map[string]*HealthMonitor) {
+	if registerer == prometheus.DefaultRegisterer {
+		mux.Handle("/metrics", promhttp.Handler())
+	} else if gatherer, ok := registerer.(prometheus.Gatherer); ok {
+		mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	}
+	status := NewStatusMux(monitors)
+	for _, path := range []string{"/status", "/livez", "/readyz"} {
+		mux.Handle(path, status)
 	}
 }
 
+// metricLabels are the label names of the metrics, which the labels of an
+// instance can not use
+var metricLabels = []string{"server", "pool", "route", "code", "reason", "result", "backend", "success", "reused"}
+
+// MetricsConfig configures the metrics the frontends share, it is read from
+// the top level only and changes to it require a restart. Buckets are the
+// upper bounds in seconds of the latency histograms, they default to those
+// of prometheus
+type MetricsConfig struct {
+	Buckets []float64 `yaml:"buckets"`
+}
+
+func (config *MetricsConfig) setDefaults() {
+	if len(config.Buckets) == 0 {
+		config.Buckets = prometheus.DefBuckets
+	}
+}
+
+func (config MetricsConfig) validate() error {
+	for i, bucket := range config.Buckets {
+		if bucket <= 0 || (i > 0 && bucket <= config.Buckets[i-1]) {
+			return fmt.Errorf("Buckets must be positive and increasing: %v", config.Buckets)
+		}
+	}
+	return nil
+}
+
+// metricsFactory creates metrics on a registerer with the labels of an
+// instance. Metrics registered before under the same name and labels are
+// shared, so that the frontends of a process share their collectors
+type metricsFactory struct {
+	registerer prometheus.Registerer
+	labels     prometheus.Labels
+}
+
+// defaultMetrics registers metrics on the default prometheus registry
+var defaultMetrics = metricsFactory{registerer: prometheus.DefaultRegisterer}
+
 // HealthMonitorMetrics contains the health monitor metrics
 type HealthMonitorMetrics struct {
 	numUnhealthyPorts *prometheus.GaugeVec
 	status            *prometheus.GaugeVec
+	ejections         *prometheus.CounterVec
+	ejected           *prometheus.GaugeVec
+	weight            *prometheus.GaugeVec
 }
 
-// NewHealthMonitorMetrics creates an instance of HealthMonitorMetrics
+// NewHealthMonitorMetrics creates an instance of HealthMonitorMetrics on the
+// default prometheus registry
 func NewHealthMonitorMetrics() HealthMonitorMetrics {
+	return defaultMetrics.newHealthMonitorMetrics()
+}
+
+func (factory metricsFactory) newHealthMonitorMetrics() HealthMonitorMetrics {
 	return HealthMonitorMetrics{
-		status:            newGaugeMetric("tcp_mux_proxy_status", "Current health status of this server (1 = UP, 0 = DOWN)", []string{"server"}),
-		numUnhealthyPorts: newGaugeMetric("tcp_mux_proxy_unhealthy_ports", "Current number of unhealthy ports on this server", []string{"server"}),
+		status:            factory.newGaugeMetric("tcp_mux_proxy_status", "Current health status of a pool of this server (1 = UP, 0 = DOWN)", []string{"server", "pool"}),
+		numUnhealthyPorts: factory.newGaugeMetric("tcp_mux_proxy_unhealthy_ports", "Current number of unhealthy ports in a pool of this server", []string{"server", "pool"}),
+		ejections:         factory.newCounterMetric("tcp_mux_proxy_outlier_ejections_total", "Total of backend ejections by outlier detection", []string{"server", "backend", "reason"}),
+		ejected:           factory.newGaugeMetric("tcp_mux_proxy_outlier_ejected", "Whether a backend is currently ejected by outlier detection (1 = ejected)", []string{"server", "backend"}),
+		weight:            factory.newGaugeMetric("tcp_mux_proxy_backend_weight", "Current load balancing weight of a backend", []string{"server", "backend"}),
 	}
 }
 
@@ -45,11 +111,16 @@ type ProxyServerMetrics struct {
 	timeHealthy   *prometheus.SummaryVec
 }
 
-// NewProxyServerMetrics creates an instance of ProxyServerMetrics
+// NewProxyServerMetrics creates an instance of ProxyServerMetrics on the
+// default prometheus registry
 func NewProxyServerMetrics() *ProxyServerMetrics {
+	return defaultMetrics.newProxyServerMetrics()
+}
+
+func (factory metricsFactory) newProxyServerMetrics() *ProxyServerMetrics {
 	return &ProxyServerMetrics{
-		timeUnhealthy: newSummaryMetric("tcp_mux_proxy_continuous_time_unhealthy_seconds", "Length of time for server to come back up", []string{"server"}),
-		timeHealthy:   newSummaryMetric("tcp_mux_proxy_continuous_time_healthy_seconds", "Length of time between successive surver shutdowns", []string{"server"}),
+		timeUnhealthy: factory.newSummaryMetric("tcp_mux_proxy_continuous_time_unhealthy_seconds", "Length of time for server to come back up", []string{"server"}),
+		timeHealthy:   factory.newSummaryMetric("tcp_mux_proxy_continuous_time_healthy_seconds", "Length of time between successive surver shutdowns", []string{"server"}),
 	}
 }
 
@@ -59,50 +130,115 @@ type ProxyHandlerMetrics struct {
 	httpRequests         *prometheus.CounterVec
 	numActiveConnections *prometheus.GaugeVec
 	handleTimeNS         *prometheus.SummaryVec
+	tcpConnections       *prometheus.CounterVec
+	retries              *prometheus.CounterVec
+	// requests waiting for a connection slot
+	queueLength      *prometheus.GaugeVec
+	queuedRequests   *prometheus.CounterVec
+	queueWaitSeconds *prometheus.SummaryVec
+	// connection pool stats of the backend transports
+	backendDials           *prometheus.CounterVec
+	backendOpenConnections *prometheus.GaugeVec
+	backendConnsAcquired   *prometheus.CounterVec
+	// requests to each backend, retries included
+	backendRequests      *prometheus.CounterVec
+	backendErrors        *prometheus.CounterVec
+	backendFirstByte     *prometheus.HistogramVec
+	backendDuration      *prometheus.HistogramVec
+	backendSentBytes     *prometheus.CounterVec
+	backendReceivedBytes *prometheus.CounterVec
 }
 
-// NewProxyHandlerMetrics creates an instance of ProxyHandlerMetrics
+// NewProxyHandlerMetrics creates an instance of ProxyHandlerMetrics on the
+// default prometheus registry
 func NewProxyHandlerMetrics() *ProxyHandlerMetrics {
+	return defaultMetrics.newProxyHandlerMetrics(nil)
+}
+
+// newProxyHandlerMetrics creates the metrics with latency histograms of
+// buckets, the default ones of prometheus if empty
+func (factory metricsFactory) newProxyHandlerMetrics(buckets []float64) *ProxyHandlerMetrics {
+	backendLabels := []string{"server", "backend", "route", "code"}
 	return &ProxyHandlerMetrics{
-		httpResponses:        newCounterMetric("tcp_mux_proxy_http_responses_total", "Total of HTTP responses.", []string{"server", "code"}),
-		httpRequests:         newCounterMetric("tcp_mux_proxy_http_requests_total", "Total of HTTP requests.", []string{"server"}),
-		numActiveConnections: newGaugeMetric("tcp_mux_proxy_port_active_connections", "Current number of active connections for a downstream", []string{"backend"}),
-		handleTimeNS:         newSummaryMetric("tcp_mux_proxy_handling_time_ns", "Time in ns to verify num connections is below limit and choose a downstream", []string{"server"}),
+		httpResponses:          factory.newCounterMetric("tcp_mux_proxy_http_responses_total", "Total of HTTP responses.", []string{"server", "pool", "code"}),
+		httpRequests:           factory.newCounterMetric("tcp_mux_proxy_http_requests_total", "Total of HTTP requests.", []string{"server", "pool"}),
+		numActiveConnections:   factory.newGaugeMetric("tcp_mux_proxy_port_active_connections", "Current number of active connections for a downstream", []string{"server", "backend"}),
+		handleTimeNS:           factory.newSummaryMetric("tcp_mux_proxy_handling_time_ns", "Time in ns to verify num connections is below limit and choose a downstream", []string{"server"}),
+		tcpConnections:         factory.newCounterMetric("tcp_mux_proxy_tcp_connections_total", "Total of raw TCP connections.", []string{"server", "result"}),
+		retries:                factory.newCounterMetric("tcp_mux_proxy_retries_total", "Total of retryable HTTP request failures, by whether they were retried.", []string{"server", "pool", "reason", "result"}),
+		queueLength:            factory.newGaugeMetric("tcp_mux_proxy_queue_length", "Current number of requests waiting for a connection slot", []string{"server"}),
+		queuedRequests:         factory.newCounterMetric("tcp_mux_proxy_queued_requests_total", "Total of requests that had to wait for a connection slot, by how the wait ended.", []string{"server", "result"}),
+		queueWaitSeconds:       factory.newSummaryMetric("tcp_mux_proxy_queue_wait_seconds", "Time requests waited in the queue for a connection slot", []string{"server"}),
+		backendDials:           factory.newCounterMetric("tcp_mux_proxy_backend_dials_total", "Total of connections dialed to a backend by the HTTP proxy.", []string{"server", "backend", "success"}),
+		backendOpenConnections: factory.newGaugeMetric("tcp_mux_proxy_backend_open_connections", "Current number of open HTTP connections to a backend, idle or in use", []string{"server", "backend"}),
+		backendConnsAcquired:   factory.newCounterMetric("tcp_mux_proxy_backend_connections_acquired_total", "Total of HTTP connections taken from the pool of a backend, by whether they were reused.", []string{"server", "backend", "reused"}),
+		backendRequests:        factory.newCounterMetric("tcp_mux_proxy_backend_requests_total", "Total of HTTP requests sent to a backend, by route and status class.", backendLabels),
+		backendErrors:          factory.newCounterMetric("tcp_mux_proxy_backend_errors_total", "Total of HTTP requests to a backend that failed without a response, by reason.", []string{"server", "backend", "route", "reason"}),
+		backendFirstByte:       factory.newHistogramMetric("tcp_mux_proxy_backend_time_to_first_byte_seconds", "Time a backend took to send the headers of its response", backendLabels, buckets),
+		backendDuration:        factory.newHistogramMetric("tcp_mux_proxy_backend_request_duration_seconds", "Time from sending a request to a backend until its response body was read", backendLabels, buckets),
+		backendSentBytes:       factory.newCounterMetric("tcp_mux_proxy_backend_sent_bytes_total", "Total of request body bytes, or bytes in tcp mode, sent to a backend.", []string{"server", "backend"}),
+		backendReceivedBytes:   factory.newCounterMetric("tcp_mux_proxy_backend_received_bytes_total", "Total of response body bytes, or bytes in tcp mode, received from a backend.", []string{"server", "backend"}),
 	}
 }
 
-func newGaugeMetric(metricName string, docString string, labels []string) *prometheus.GaugeVec {
+// register registers a metric, or returns the one registered before under the
+// same name, so that the metrics of several frontends in one process share
+// their collectors
+func (factory metricsFactory) register(metric prometheus.Collector) prometheus.Collector {
+	if err := factory.registerer.Register(metric); err != nil {
+		if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return registered.ExistingCollector
+		}
+		panic(err)
+	}
+	return metric
+}
+
+func (factory metricsFactory) newGaugeMetric(metricName string, docString string, labels []string) *prometheus.GaugeVec {
 	metric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: metricName,
-			Help: docString,
+			Name:        metricName,
+			Help:        docString,
+			ConstLabels: factory.labels,
 		},
 		labels,
 	)
-	prometheus.MustRegister(metric)
-	return metric
+	return factory.register(metric).(*prometheus.GaugeVec)
 }
 
-func newCounterMetric(metricName string, docString string, labels []string) *prometheus.CounterVec {
+func (factory metricsFactory) newCounterMetric(metricName string, docString string, labels []string) *prometheus.CounterVec {
 	metric := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: metricName,
-			Help: docString,
+			Name:        metricName,
+			Help:        docString,
+			ConstLabels: factory.labels,
 		},
 		labels,
 	)
-	prometheus.MustRegister(metric)
-	return metric
+	return factory.register(metric).(*prometheus.CounterVec)
 }
 
-func newSummaryMetric(metricName string, docString string, labels []string) *prometheus.SummaryVec {
+func (factory metricsFactory) newSummaryMetric(metricName string, docString string, labels []string) *prometheus.SummaryVec {
 	metric := prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
-			Name: metricName,
-			Help: docString,
+			Name:        metricName,
+			Help:        docString,
+			ConstLabels: factory.labels,
 		},
 		labels,
 	)
-	prometheus.MustRegister(metric)
-	return metric
+	return factory.register(metric).(*prometheus.SummaryVec)
+}
+
+func (factory metricsFactory) newHistogramMetric(metricName string, docString string, labels []string, buckets []float64) *prometheus.HistogramVec {
+	metric := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        metricName,
+			Help:        docString,
+			ConstLabels: factory.labels,
+			Buckets:     buckets,
+		},
+		labels,
+	)
+	return factory.register(metric).(*prometheus.HistogramVec)
 }
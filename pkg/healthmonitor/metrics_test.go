@@ -0,0 +1,184 @@
+package healthmonitor
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func newMetricsTestConfig(weight uint32) *Config {
+	var config Config
+	config.Proxy.Name = "metrics_test"
+	config.Backend = []BackendPort{{
+		Name:                "metrics_1",
+		URL:                 &url.URL{Scheme: "http", Host: "localhost:3000"},
+		HealthCheckInterval: time.Hour,
+		Rise:                1,
+		Fall:                1,
+		Weight:              weight,
+		HealthCheck:         HealthCheckConfig{Checker: &switchChecker{healthy: 1}},
+	}}
+	return &config
+}
+
+func TestIsolatedMetrics(t *testing.T) {
+	// proxies with the same names do not share the metrics of their registry
+	first, second := prometheus.NewRegistry(), prometheus.NewRegistry()
+	for i, registry := range []*prometheus.Registry{first, second} {
+		if _, err := New(newMetricsTestConfig(uint32(i+1)), WithMetricsBind(""), WithRegisterer(registry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend := map[string]string{"backend": "metrics_1"}
+	if weight := gatherMetric(t, first, "tcp_mux_proxy_backend_weight", backend).GetGauge().GetValue(); weight != 1 {
+		t.Errorf("Expected the first registry to have weight 1, got %v", weight)
+	}
+	if weight := gatherMetric(t, second, "tcp_mux_proxy_backend_weight", backend).GetGauge().GetValue(); weight != 2 {
+		t.Errorf("Expected the second registry to have weight 2, got %v", weight)
+	}
+
+	// proxies sharing a registry are told apart by their labels
+	shared := prometheus.NewRegistry()
+	for i, instance := range []string{"a", "b"} {
+		if _, err := New(newMetricsTestConfig(uint32(i+1)), WithMetricsBind(""), WithRegisterer(shared), WithLabels(prometheus.Labels{"instance": instance})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, instance := range []string{"a", "b"} {
+		if weight := gatherMetric(t, shared, "tcp_mux_proxy_backend_weight", map[string]string{"instance": instance}).GetGauge().GetValue(); weight != float64(i+1) {
+			t.Errorf("Expected instance %v in the shared registry to have weight %v, got %v", instance, i+1, weight)
+		}
+	}
+
+	// frontends with backends of the same name are told apart by the server
+	frontends := prometheus.NewRegistry()
+	for i, name := range []string{"metrics_a", "metrics_b"} {
+		config := newMetricsTestConfig(uint32(i + 1))
+		config.Proxy.Name = name
+		if _, err := New(config, WithMetricsBind(""), WithRegisterer(frontends)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, name := range []string{"metrics_a", "metrics_b"} {
+		if weight := gatherMetric(t, frontends, "tcp_mux_proxy_backend_weight", map[string]string{"server": name, "backend": "metrics_1"}).GetGauge().GetValue(); weight != float64(i+1) {
+			t.Errorf("Expected the backend of %v to have weight %v, got %v", name, i+1, weight)
+		}
+	}
+
+	if _, err := New(newMetricsTestConfig(1), WithMetricsBind(""), WithRegisterer(prometheus.NewRegistry()), WithLabels(prometheus.Labels{"backend": "x"})); err == nil {
+		t.Error("Expected a label used by the metrics to be refused")
+	}
+}
+
+func TestMetricsServeMux(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	mux := http.NewServeMux()
+	if _, err := New(newMetricsTestConfig(3), WithServeMux(mux), WithRegisterer(registry)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/metrics", "/livez", "/readyz", "/status"} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected %v to be served, got %v", path, recorder.Code)
+		}
+		if path == "/metrics" && !strings.Contains(recorder.Body.String(), `tcp_mux_proxy_backend_weight{backend="metrics_1",server="metrics_test"} 3`) {
+			t.Errorf("Expected /metrics to serve the registry, got %v", recorder.Body)
+		}
+	}
+}
+
+// gatherMetric returns the metric gathered from registry under name whose
+// labels include labels, or nil if there is none
+func gatherMetric(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) *dto.Metric {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				return metric
+			}
+		}
+	}
+	t.Errorf("Expected a metric %v with labels %v", name, labels)
+	return nil
+}
+
+func TestBackendMetrics(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello")
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+	// nothing listens on the port of a closed server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL, _ := url.Parse(closed.URL)
+	closed.Close()
+
+	config := newMetricsTestConfig(1)
+	config.Proxy.MaxConn = 10
+	config.Metrics.Buckets = []float64{0.5, 1}
+	config.Backend[0].URL = downstreamURL
+	config.Backend = append(config.Backend, config.Backend[0])
+	config.Backend[1].Name, config.Backend[1].URL, config.Backend[1].Pool = "metrics_2", closedURL, "down"
+	config.Pools = []PoolConfig{{Name: "down"}}
+	config.Routes = []RouteConfig{{Name: "to_closed", PathPrefix: "/closed/", Pool: "down"}}
+	registry := prometheus.NewRegistry()
+	proxy, err := New(config, WithMetricsBind(""), WithRegisterer(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &proxy.frontends[0].proxy.ph
+	for _, path := range []string{"/", "/closed/"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader("ping")))
+	}
+
+	ok := map[string]string{"backend": "metrics_1", "route": DefaultPool, "code": "2xx"}
+	if requests := gatherMetric(t, registry, "tcp_mux_proxy_backend_requests_total", ok).GetCounter().GetValue(); requests != 1 {
+		t.Errorf("Expected 1 request to metrics_1, got %v", requests)
+	}
+	for _, name := range []string{"tcp_mux_proxy_backend_time_to_first_byte_seconds", "tcp_mux_proxy_backend_request_duration_seconds"} {
+		histogram := gatherMetric(t, registry, name, ok).GetHistogram()
+		if count, buckets := histogram.GetSampleCount(), len(histogram.GetBucket()); count != 1 || buckets != 2 {
+			t.Errorf("Expected %v to observe 1 request in 2 buckets, got %v in %v", name, count, buckets)
+		}
+	}
+	bytesLabels := map[string]string{"backend": "metrics_1"}
+	if sent := gatherMetric(t, registry, "tcp_mux_proxy_backend_sent_bytes_total", bytesLabels).GetCounter().GetValue(); sent != 4 {
+		t.Errorf("Expected 4 bytes sent, got %v", sent)
+	}
+	if received := gatherMetric(t, registry, "tcp_mux_proxy_backend_received_bytes_total", bytesLabels).GetCounter().GetValue(); received != 5 {
+		t.Errorf("Expected 5 bytes received, got %v", received)
+	}
+
+	failed := map[string]string{"backend": "metrics_2", "route": "to_closed", "reason": "connection"}
+	if errors := gatherMetric(t, registry, "tcp_mux_proxy_backend_errors_total", failed).GetCounter().GetValue(); errors != 1 {
+		t.Errorf("Expected 1 error from metrics_2, got %v", errors)
+	}
+	failed = map[string]string{"backend": "metrics_2", "route": "to_closed", "code": "error"}
+	if requests := gatherMetric(t, registry, "tcp_mux_proxy_backend_requests_total", failed).GetCounter().GetValue(); requests != 1 {
+		t.Errorf("Expected 1 failed request to metrics_2, got %v", requests)
+	}
+}
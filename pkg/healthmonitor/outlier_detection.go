@@ -0,0 +1,275 @@
+package healthmonitor
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultOutlierInterval           = 10 * time.Second
+	defaultOutlierBaseEjectionTime   = 30 * time.Second
+	defaultOutlierMaxEjectionTime    = 300 * time.Second
+	defaultOutlierMaxEjectionPercent = 10
+	defaultOutlierMinimumHosts       = 5
+	defaultOutlierRequestVolume      = 100
+)
+
+// OutlierDetectionConfig configures passive health checking, which ejects
+// backends from the load balancer based on the results of live traffic.
+// Consecutive errors counts 5xx responses and connection errors, the success
+// rate check ejects backends whose success rate is more than
+// SuccessRateStdevFactor standard deviations below the mean of the pool.
+// Both are disabled when zero. Pools are separate services, so the success
+// rate and MaxEjectionPercent are applied within each pool
+type OutlierDetectionConfig struct {
+	ConsecutiveErrors        int           `yaml:"consecutive_errors"`
+	SuccessRateStdevFactor   float64       `yaml:"success_rate_stdev_factor"`
+	SuccessRateMinimumHosts  int           `yaml:"success_rate_minimum_hosts"`
+	SuccessRateRequestVolume int           `yaml:"success_rate_request_volume"`
+	Interval                 time.Duration `yaml:"interval"`
+	BaseEjectionTime         time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime          time.Duration `yaml:"max_ejection_time"`
+	MaxEjectionPercent       int           `yaml:"max_ejection_percent"`
+}
+
+func (config OutlierDetectionConfig) enabled() bool {
+	return config.ConsecutiveErrors > 0 || config.SuccessRateStdevFactor > 0
+}
+
+func (config *OutlierDetectionConfig) setDefaults() {
+	if config.Interval <= 0 {
+		config.Interval = defaultOutlierInterval
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if config.MaxEjectionTime <= 0 {
+		config.MaxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+	if config.SuccessRateMinimumHosts <= 0 {
+		config.SuccessRateMinimumHosts = defaultOutlierMinimumHosts
+	}
+	if config.SuccessRateRequestVolume <= 0 {
+		config.SuccessRateRequestVolume = defaultOutlierRequestVolume
+	}
+}
+
+// outlierDetector counts the results of proxied requests per backend and
+// ejects the outliers through the HealthMonitor
+type outlierDetector struct {
+	hm *HealthMonitor
+
+	// stats holds the current map[string]*outlierStats, it is replaced on
+	// reload so requests can record results without taking a lock
+	stats atomic.Value
+
+	// mu guards config and the pool and ejection state of every outlierStats
+	mu     sync.Mutex
+	config OutlierDetectionConfig
+}
+
+type outlierStats struct {
+	consecutiveErrors uint32
+	successes         uint32
+	failures          uint32
+
+	pool string
+
+	ejected      bool
+	ejectedUntil time.Time
+	// ejections grows with every ejection and shrinks for every interval
+	// the backend stays in, so repeat offenders are ejected for longer
+	ejections uint
+}
+
+func newOutlierDetector(hm *HealthMonitor, config OutlierDetectionConfig, backends []BackendPort) *outlierDetector {
+	config.setDefaults()
+	detector := &outlierDetector{hm: hm, config: config}
+	stats := make(map[string]*outlierStats, len(backends))
+	for _, backend := range backends {
+		stats[backend.Name] = &outlierStats{pool: backend.poolName()}
+	}
+	detector.stats.Store(stats)
+	return detector
+}
+
+// reload keeps the stats of the backends that are still configured. It must
+// be called with hm.mu held, and returns the names of the ejected backends
+func (detector *outlierDetector) reload(config OutlierDetectionConfig, backends []BackendPort) map[string]bool {
+	config.setDefaults()
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	detector.config = config
+	old := detector.stats.Load().(map[string]*outlierStats)
+	stats := make(map[string]*outlierStats, len(backends))
+	ejected := make(map[string]bool)
+	for _, backend := range backends {
+		backendStats, ok := old[backend.Name]
+		if !ok || !config.enabled() {
+			backendStats = &outlierStats{}
+		}
+		backendStats.pool = backend.poolName()
+		stats[backend.Name] = backendStats
+		if backendStats.ejected {
+			ejected[backend.Name] = true
+		}
+	}
+	detector.stats.Store(stats)
+	return ejected
+}
+
+// record counts the result of a request proxied to the named backend
+func (detector *outlierDetector) record(name string, success bool) {
+	backendStats, ok := detector.stats.Load().(map[string]*outlierStats)[name]
+	if !ok {
+		return
+	}
+	if success {
+		atomic.StoreUint32(&backendStats.consecutiveErrors, 0)
+		atomic.AddUint32(&backendStats.successes, 1)
+		return
+	}
+
+	atomic.AddUint32(&backendStats.failures, 1)
+	errors := atomic.AddUint32(&backendStats.consecutiveErrors, 1)
+	detector.mu.Lock()
+	threshold := detector.config.ConsecutiveErrors
+	detector.mu.Unlock()
+	if threshold > 0 && errors >= uint32(threshold) {
+		detector.eject(name, backendStats, "consecutive_errors")
+	}
+}
+
+// eject takes a backend out of rotation unless that would exceed the maximum
+// ejection percentage of its pool. At least one backend of a pool can always
+// be ejected
+func (detector *outlierDetector) eject(name string, backendStats *outlierStats, reason string) {
+	detector.mu.Lock()
+	if backendStats.ejected {
+		detector.mu.Unlock()
+		return
+	}
+	stats := detector.stats.Load().(map[string]*outlierStats)
+	numBackends, numEjected := 0, 0
+	for _, other := range stats {
+		if other.pool != backendStats.pool {
+			continue
+		}
+		numBackends++
+		if other.ejected {
+			numEjected++
+		}
+	}
+	maxEjected := numBackends * detector.config.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	if numEjected >= maxEjected {
+		detector.mu.Unlock()
+		return
+	}
+
+	ejectionTime := detector.config.BaseEjectionTime * time.Duration(1<<backendStats.ejections)
+	if ejectionTime > detector.config.MaxEjectionTime || ejectionTime <= 0 {
+		ejectionTime = detector.config.MaxEjectionTime
+	} else {
+		backendStats.ejections++
+	}
+	backendStats.ejected = true
+	backendStats.ejectedUntil = time.Now().Add(ejectionTime)
+	atomic.StoreUint32(&backendStats.consecutiveErrors, 0)
+	detector.mu.Unlock()
+
+	detector.hm.metrics.ejections.With(prometheus.Labels{"server": detector.hm.serverLabel["server"], "backend": name, "reason": reason}).Inc()
+	detector.hm.setEjected(name, true)
+}
+
+// run un-ejects backends whose ejection time is over and runs the success
+// rate check every interval, until ctx is done
+func (detector *outlierDetector) run(ctx context.Context) {
+	for {
+		detector.mu.Lock()
+		interval := detector.config.Interval
+		detector.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		detector.evaluate(time.Now())
+	}
+}
+
+func (detector *outlierDetector) evaluate(now time.Time) {
+	detector.mu.Lock()
+	stats := detector.stats.Load().(map[string]*outlierStats)
+	config := detector.config
+
+	var recovered []string
+	// success rates by pool, then by backend
+	rates := make(map[string]map[string]float64)
+	for name, backendStats := range stats {
+		successes := atomic.SwapUint32(&backendStats.successes, 0)
+		failures := atomic.SwapUint32(&backendStats.failures, 0)
+		if backendStats.ejected {
+			if now.After(backendStats.ejectedUntil) {
+				backendStats.ejected = false
+				recovered = append(recovered, name)
+			}
+			continue
+		}
+		if backendStats.ejections > 0 {
+			backendStats.ejections--
+		}
+		if total := successes + failures; total > 0 && total >= uint32(config.SuccessRateRequestVolume) {
+			if rates[backendStats.pool] == nil {
+				rates[backendStats.pool] = make(map[string]float64)
+			}
+			rates[backendStats.pool][name] = float64(successes) / float64(total)
+		}
+	}
+	detector.mu.Unlock()
+
+	for _, name := range recovered {
+		detector.hm.setEjected(name, false)
+	}
+
+	if config.SuccessRateStdevFactor <= 0 {
+		return
+	}
+	for _, poolRates := range rates {
+		detector.ejectSuccessRateOutliers(config, stats, poolRates)
+	}
+}
+
+// ejectSuccessRateOutliers ejects the backends of a pool whose success rate
+// is too far below the mean of the pool
+func (detector *outlierDetector) ejectSuccessRateOutliers(config OutlierDetectionConfig, stats map[string]*outlierStats, rates map[string]float64) {
+	if len(rates) < config.SuccessRateMinimumHosts {
+		return
+	}
+	var mean, variance float64
+	for _, rate := range rates {
+		mean += rate
+	}
+	mean /= float64(len(rates))
+	for _, rate := range rates {
+		variance += (rate - mean) * (rate - mean)
+	}
+	limit := mean - config.SuccessRateStdevFactor*math.Sqrt(variance/float64(len(rates)))
+	for name, rate := range rates {
+		if rate < limit {
+			detector.eject(name, stats[name], "success_rate")
+		}
+	}
+}
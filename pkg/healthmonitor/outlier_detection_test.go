@@ -0,0 +1,155 @@
+package healthmonitor
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	var config Config
+	config.Proxy.Name = "outlier_test"
+	config.Proxy.OutlierDetection = OutlierDetectionConfig{
+		ConsecutiveErrors:  3,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionPercent: 50,
+	}
+	for i := 0; i < 4; i++ {
+		config.Backend = append(config.Backend, BackendPort{Name: "server_" + strconv.Itoa(i)})
+	}
+
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	detector := healthMonitor.outliers
+	fail := func(name string, times int) {
+		for i := 0; i < times; i++ {
+			detector.record(name, false)
+		}
+	}
+	stats := func(name string) *outlierStats {
+		return detector.stats.Load().(map[string]*outlierStats)[name]
+	}
+
+	fail("server_0", 2)
+	detector.record("server_0", true)
+	fail("server_0", 2)
+	if healthMonitor.checks["server_0"].ejected {
+		t.Fatal("A success should reset the consecutive error count")
+	}
+	fail("server_0", 1)
+	if !healthMonitor.checks["server_0"].ejected {
+		t.Fatal("Expected server_0 to be ejected after 3 consecutive errors")
+	}
+	if healthMonitor.checks["server_0"].state != StateUnknown || healthMonitor.IsUnhealthy() {
+		t.Error("Ejection should not change the health state")
+	}
+
+	fail("server_1", 3)
+	fail("server_2", 3)
+	if !healthMonitor.checks["server_1"].ejected || healthMonitor.checks["server_2"].ejected {
+		t.Fatal("Expected max_ejection_percent to allow exactly 2 ejections")
+	}
+
+	// active health checks must not put an ejected backend back in rotation
+	healthMonitor.observe(healthMonitor.checks["server_0"], false)
+	healthMonitor.observe(healthMonitor.checks["server_0"], true)
+	if healthMonitor.checks["server_0"].inRotation() {
+		t.Error("Ejected backend was put back in rotation by a health check")
+	}
+
+	// the reload keeps the ejections of the remaining backends
+	healthMonitor.Reload(&config)
+	if !healthMonitor.checks["server_0"].ejected {
+		t.Error("Ejection was lost on reload")
+	}
+
+	detector.evaluate(time.Now().Add(31 * time.Second))
+	if healthMonitor.checks["server_0"].ejected || healthMonitor.checks["server_1"].ejected {
+		t.Fatal("Expected the ejections to expire")
+	}
+
+	// a second ejection lasts twice as long
+	fail("server_0", 3)
+	if until := time.Until(stats("server_0").ejectedUntil); until < 59*time.Second || until > 61*time.Second {
+		t.Errorf("Expected a 60s ejection, got %v", until)
+	}
+	detector.evaluate(time.Now().Add(61 * time.Second))
+
+	config.Proxy.OutlierDetection = OutlierDetectionConfig{
+		SuccessRateStdevFactor:   1,
+		SuccessRateMinimumHosts:  4,
+		SuccessRateRequestVolume: 10,
+		MaxEjectionPercent:       50,
+	}
+	healthMonitor.Reload(&config)
+	for i := 0; i < 20; i++ {
+		for _, backend := range config.Backend {
+			detector.record(backend.Name, backend.Name != "server_3" || i%2 == 0)
+		}
+	}
+	detector.evaluate(time.Now())
+	for _, backend := range config.Backend {
+		if ejected := healthMonitor.checks[backend.Name].ejected; ejected != (backend.Name == "server_3") {
+			t.Errorf("%v: unexpected ejected state %v", backend.Name, ejected)
+		}
+	}
+}
+
+func TestOutlierDetectionPools(t *testing.T) {
+	var config Config
+	config.Proxy.Name = "outlier_pools_test"
+	config.Proxy.OutlierDetection = OutlierDetectionConfig{
+		ConsecutiveErrors:  3,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionPercent: 50,
+	}
+	for i := 0; i < 4; i++ {
+		config.Backend = append(config.Backend, BackendPort{Name: "server_" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 2; i++ {
+		config.Backend = append(config.Backend, BackendPort{Name: "api_" + strconv.Itoa(i), Pool: "api"})
+	}
+	config.Pools = []PoolConfig{{Name: "api"}}
+
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	detector := healthMonitor.outliers
+	fail := func(name string) {
+		for i := 0; i < 3; i++ {
+			detector.record(name, false)
+		}
+	}
+
+	// the api pool can only lose one of its two backends, which does not
+	// count against the default pool
+	fail("api_0")
+	fail("api_1")
+	fail("server_0")
+	fail("server_1")
+	for name, expected := range map[string]bool{"api_0": true, "api_1": false, "server_0": true, "server_1": true} {
+		if ejected := healthMonitor.checks[name].ejected; ejected != expected {
+			t.Errorf("%v: expected ejected %v, got %v", name, expected, ejected)
+		}
+	}
+	detector.evaluate(time.Now().Add(31 * time.Second))
+
+	// a pool that does worse than another is not an outlier of its own
+	config.Proxy.OutlierDetection = OutlierDetectionConfig{
+		SuccessRateStdevFactor:   1,
+		SuccessRateMinimumHosts:  2,
+		SuccessRateRequestVolume: 10,
+		MaxEjectionPercent:       50,
+	}
+	healthMonitor.Reload(&config)
+	for i := 0; i < 20; i++ {
+		for _, backend := range config.Backend {
+			detector.record(backend.Name, backend.Pool == "" || i%2 == 0)
+		}
+	}
+	detector.evaluate(time.Now())
+	for _, backend := range config.Backend {
+		if healthMonitor.checks[backend.Name].ejected {
+			t.Errorf("%v: expected the success rate to be compared within its pool", backend.Name)
+		}
+	}
+}
@@ -2,10 +2,17 @@ package healthmonitor
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,44 +20,148 @@ import (
 	"github.com/wish/tcp-mux-proxy/pkg/loadbalancer"
 )
 
+// listenServer is the part of http.Server the ProxyServer relies on, so the
+// raw tcp server can be run in its place
+type listenServer interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// httpServer serves an http.Server on a listener that reads PROXY protocol
+// headers, over TLS with the certificates of its TLSConfig if set
+type httpServer struct {
+	*http.Server
+	ph *proxyHandler
+}
+
+func (s *httpServer) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	listener = &proxyProtocolListener{Listener: listener, ph: s.ph}
+	if s.TLSConfig != nil {
+		return s.ServeTLS(listener, "", "")
+	}
+	return s.Serve(listener)
+}
+
+// Shutdown closes the connections still active once ctx is done, like the
+// tcp server does
+func (s *httpServer) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if err != nil && err == ctx.Err() {
+		s.Server.Close()
+	}
+	return err
+}
+
 // ProxyServer encapsulates the server and config for the proxy
 type ProxyServer struct {
-	server              *http.Server
-	ph                  proxyHandler
-	bind                string
-	shutdownInProgress  uint32
-	metrics             *ProxyServerMetrics
+	// serverMu guards server and closed
+	serverMu           sync.Mutex
+	server             listenServer
+	closed             bool
+	ph                 proxyHandler
+	bind               string
+	mode               string
+	shutdownInProgress uint32
+	metrics            *ProxyServerMetrics
+	// factory creates the metrics of the server and its health monitor
+	factory             metricsFactory
 	lastStateChangeTime time.Time
 	nameLabel           prometheus.Labels
 	firstStart          bool
 	name                string
+	// certs is nil unless tls is configured
+	certs *certWatcher
+	// monitor is set by the HealthMonitor of the server, if any
+	monitor *HealthMonitor
+	// wake is signalled whenever the server may be started again
+	wake chan struct{}
+
+	// drainMu guards the drain state of the server in drain shutdown mode
+	drainMu     sync.Mutex
+	drainTimer  *time.Timer
+	abortCancel context.CancelFunc
 }
 
-// NewProxyServer builds a proxy server and returns it
+// NewProxyServer builds a proxy server and returns it, its metrics are
+// registered on the default prometheus registry. It panics if the backends of
+// a config returned by ParseConfig can no longer be loaded, New returns an
+// error instead
 func NewProxyServer(config *Config) *ProxyServer {
+	proxyServer, err := newProxyServer(config, defaultMetrics)
+	if err != nil {
+		panic(err)
+	}
+	return proxyServer
+}
+
+func newProxyServer(config *Config, factory metricsFactory) (*ProxyServer, error) {
 	proxyServer := &ProxyServer{
 		ph: proxyHandler{
-			lb:       loadbalancer.NewPowerOfTwoLoadBalancer(uint16(len(config.Backend))),
-			maxConn:  uint32(config.Proxy.MaxConn),
-			backends: config.Backend,
-			metrics:  NewProxyHandlerMetrics(),
-			name:     config.Proxy.Name,
+			maxConn:      uint32(config.Proxy.MaxConn),
+			shutdownMode: config.Proxy.ShutdownMode,
+			metrics:      factory.newProxyHandlerMetrics(config.Metrics.Buckets),
+			name:         config.Proxy.Name,
 		},
 		bind:                config.Proxy.Bind,
+		mode:                config.Proxy.Mode,
 		shutdownInProgress:  0,
-		metrics:             NewProxyServerMetrics(),
+		metrics:             factory.newProxyServerMetrics(),
+		factory:             factory,
 		nameLabel:           prometheus.Labels{"server": config.Proxy.Name},
 		firstStart:          true,
 		lastStateChangeTime: time.Now(),
+		name:                config.Proxy.Name,
+		wake:                make(chan struct{}, 1),
+	}
+	proxyServer.ph.setDrainConfig(config.Proxy.Drain)
+	proxyServer.ph.setRetryConfig(config.Proxy.Retry)
+	proxyServer.ph.setServerConfig(config.Proxy.Server)
+	proxyServer.ph.setHeadersConfig(config.Proxy.Headers)
+	proxyServer.ph.setAccessLogConfig(config.Proxy.AccessLog)
+	proxyServer.ph.setQueueConfig(config.Proxy.Queue)
+	proxyServer.ph.setProxyProtocolConfig(config.Proxy.ProxyProtocol)
+	proxyServer.newAbortContext()
+	if config.Proxy.TLS.enabled() {
+		proxyServer.certs = newCertWatcher(config.Proxy.TLS)
 	}
+	if err := proxyServer.ph.setPools(config, nil, nil); err != nil {
+		return nil, err
+	}
+	return proxyServer, nil
+}
 
-	proxies := make([]*httputil.ReverseProxy, len(config.Backend))
-	for i, portConfig := range config.Backend {
-		proxies[i] = httputil.NewSingleHostReverseProxy(portConfig.URL)
-		proxies[i].Transport = &proxyTransport{id: uint16(i), ph: &proxyServer.ph}
+// reload applies the reloadable parts of config to a running proxy server.
+// The named backends in unhealthy start out marked unhealthy in the new
+// pools, and the pools in downPools start out down
+func (proxyServer *ProxyServer) reload(config *Config, unhealthy []string, downPools []string) {
+	if config.Proxy.Bind != proxyServer.bind || config.Proxy.Mode != proxyServer.mode || config.Proxy.Name != proxyServer.name ||
+		config.Proxy.ShutdownMode != proxyServer.ph.shutdownMode {
+		log.Println("Changes to bind, mode, shutdown_mode and name require a restart and were not applied")
+	}
+	if config.Proxy.TLS.enabled() != (proxyServer.certs != nil) {
+		log.Println("Enabling or disabling tls requires a restart and was not applied")
+	} else if proxyServer.certs != nil {
+		proxyServer.certs.setConfig(config.Proxy.TLS)
+	}
+	atomic.StoreUint32(&proxyServer.ph.maxConn, uint32(config.Proxy.MaxConn))
+	proxyServer.ph.setDrainConfig(config.Proxy.Drain)
+	proxyServer.ph.setRetryConfig(config.Proxy.Retry)
+	proxyServer.ph.setServerConfig(config.Proxy.Server)
+	proxyServer.ph.setHeadersConfig(config.Proxy.Headers)
+	proxyServer.ph.setAccessLogConfig(config.Proxy.AccessLog)
+	proxyServer.ph.setQueueConfig(config.Proxy.Queue)
+	proxyServer.ph.setProxyProtocolConfig(config.Proxy.ProxyProtocol)
+	if err := proxyServer.ph.setPools(config, unhealthy, downPools); err != nil {
+		log.Printf("Could not apply the backends, keeping the previous ones: %v\n", err)
 	}
-	proxyServer.ph.proxies = proxies
-	return proxyServer
 }
 
 func (proxyServer *ProxyServer) resetTimer() float64 {
@@ -64,31 +175,113 @@ func (proxyServer *ProxyServer) IsInShutdown() bool {
 	return atomic.LoadUint32(&proxyServer.shutdownInProgress) == 1
 }
 
+// stop takes the server out of service, either by shutting it down or by
+// draining it depending on the shutdown mode
 func (proxyServer *ProxyServer) stop() {
+	if proxyServer.ph.shutdownMode == ShutdownModeDrain {
+		proxyServer.drain()
+		return
+	}
+	proxyServer.shutdown()
+}
+
+func (proxyServer *ProxyServer) shutdown() {
 	// this is necessary since stop can also be called from start if ListenAndServe gets an error
 	if atomic.CompareAndSwapUint32(&proxyServer.shutdownInProgress, uint32(0), uint32(1)) {
-		// TODO make this context cancelable
-		if err := proxyServer.server.Shutdown(context.Background()); err != nil {
-			// what handling should we have here
+		proxyServer.serverMu.Lock()
+		server := proxyServer.server
+		proxyServer.serverMu.Unlock()
+		// health checks started by a reload may fail before the server is ever started
+		if server == nil {
+			atomic.StoreUint32(&proxyServer.shutdownInProgress, 0)
+			return
+		}
+		// connections still open after the drain timeout are closed, so a long
+		// lived connection cannot keep the server from ever restarting
+		ctx, cancel := context.WithTimeout(context.Background(), proxyServer.ph.getDrainConfig().Timeout)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Could not shut down proxy server gracefully: %v\n", err)
 		}
-		proxyServer.shutdownInProgress = 0
+		cancel()
+		atomic.StoreUint32(&proxyServer.shutdownInProgress, 0)
+		proxyServer.notify()
 	}
 }
 
+// notify wakes up whoever waits to start the server again
+func (proxyServer *ProxyServer) notify() {
+	select {
+	case proxyServer.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Shutdown stops the server for good, waiting for the requests in flight
+// until ctx is done. Start returns right away once it was called
+func (proxyServer *ProxyServer) Shutdown(ctx context.Context) error {
+	proxyServer.serverMu.Lock()
+	proxyServer.closed = true
+	server := proxyServer.server
+	proxyServer.serverMu.Unlock()
+	proxyServer.notify()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+func (proxyServer *ProxyServer) isClosed() bool {
+	proxyServer.serverMu.Lock()
+	defer proxyServer.serverMu.Unlock()
+	return proxyServer.closed
+}
+
 // Start starts the proxy server
 func (proxyServer *ProxyServer) Start() error {
 	// at this point proxyHandler.curConn should be zero after shutdown
-	mux := http.NewServeMux()
-	mux.Handle("/status", &statusHandler{})
-	mux.Handle("/", &proxyServer.ph)
+	var tlsConfig *tls.Config
+	if proxyServer.certs != nil {
+		// pick up certificates that changed while the server was down
+		proxyServer.certs.reload()
+		var nextProtos []string
+		if proxyServer.mode != ModeTCP {
+			nextProtos = []string{"h2", "http/1.1"}
+		}
+		tlsConfig = proxyServer.certs.tlsConfig(nextProtos)
+		done := make(chan struct{})
+		defer close(done)
+		go proxyServer.certs.run(done)
+	}
 
-	proxyServer.server = &http.Server{
-		Addr:         proxyServer.bind,
-		Handler:      mux,
-		WriteTimeout: 10 * time.Second,
-		ReadTimeout:  5 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	var server listenServer
+	if proxyServer.mode == ModeTCP {
+		server = &tcpServer{
+			addr:      proxyServer.bind,
+			ph:        &proxyServer.ph,
+			tlsConfig: tlsConfig,
+		}
+	} else {
+		mux := http.NewServeMux()
+		mux.Handle("/status", &statusHandler{proxy: proxyServer})
+		mux.Handle("/", &proxyServer.ph)
+
+		httpSrv := &http.Server{
+			Addr:      proxyServer.bind,
+			Handler:   mux,
+			TLSConfig: tlsConfig,
+		}
+		// the connection timeouts of a running server can not be changed, so
+		// reloads only apply to them on the next start
+		proxyServer.ph.getServerLimits().applyTo(httpSrv)
+		server = &httpServer{Server: httpSrv, ph: &proxyServer.ph}
+	}
+	proxyServer.serverMu.Lock()
+	if proxyServer.closed {
+		proxyServer.serverMu.Unlock()
+		return nil
 	}
+	proxyServer.server = server
+	proxyServer.serverMu.Unlock()
 
 	// we do not want to make an observation of time unhealthy upon the first start
 	if proxyServer.firstStart {
@@ -100,82 +293,511 @@ func (proxyServer *ProxyServer) Start() error {
 
 	log.Println("Starting proxy server")
 	defer log.Println("Proxy server has shut down")
-	err := proxyServer.server.ListenAndServe()
+	err := server.ListenAndServe()
 	proxyServer.metrics.timeHealthy.With(proxyServer.nameLabel).Observe(proxyServer.resetTimer())
 
 	if err != http.ErrServerClosed {
-		proxyServer.stop()
+		proxyServer.shutdown()
 		return err
 	}
 	return nil
 }
 
-type statusHandler struct{}
-
-func (sh *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// haproxy docs say health checks consist of estabilishing tcp connection
-	// if server is in shutdown, this will fail, otherwise it will succeed
-	// this will only be needed if using httpchk
-	// http:// cbonte.github.io/haproxy-dconv/2.0/configuration.html
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+// backendPool is a snapshot of the backends of a pool, and part of a
+// routeTable
+type backendPool struct {
+	name string
+	// down is set while the pool is below its min_alive
+	down       uint32
+	lb         loadbalancer.LoadBalancer
+	backends   []BackendPort
+	proxies    []*httputil.ReverseProxy
+	transports []*http.Transport
+	// tlsConfigs are used to dial backends in tcp mode, nil for plaintext
+	tlsConfigs []*tls.Config
+	ids        map[string]uint16
+	hashKey    HashKeyConfig
 }
 
 type proxyHandler struct {
-	lb       loadbalancer.LoadBalancer
-	backends []BackendPort
-	maxConn  uint32
-	curConn  uint32
-	client   http.Client
-	metrics  *ProxyHandlerMetrics
-	proxies  []*httputil.ReverseProxy
-	name     string
+	routes  atomic.Value // *routeTable
+	maxConn uint32
+	curConn uint32
+	client  http.Client
+	metrics *ProxyHandlerMetrics
+	name    string
+	// outliers is set by the HealthMonitor, if any
+	outliers *outlierDetector
+
+	shutdownMode string
+	// draining is set while the server drains, abort holds the
+	// context.Context that cancels requests once the drain timeout expires
+	draining    uint32
+	abort       atomic.Value
+	drainConfig atomic.Value // DrainConfig
+	retry       atomic.Value // *retryPolicy
+	limits      atomic.Value // *serverLimits
+	headers     atomic.Value // *headerPolicy
+	accessLog   atomic.Value // *accessLogger
+	queue       requestQueue
+	// activeConns counts the connections to each backend by name
+	activeConns sync.Map // *int64
+	// proxyProtocol is read by the listener as connections are accepted
+	proxyProtocol atomic.Value // *proxyProtocolPolicy
 }
 
-func (ph *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	tStart := time.Now()
+func (ph *proxyHandler) getRoutes() *routeTable {
+	return ph.routes.Load().(*routeTable)
+}
+
+// getPool returns the default pool
+func (ph *proxyHandler) getPool() *backendPool {
+	return ph.getRoutes().pools[DefaultPool]
+}
+
+// setPools atomically replaces the pools and the routes to them, the current
+// ones are kept if a pool cannot be built
+func (ph *proxyHandler) setPools(config *Config, unhealthy []string, downPools []string) error {
+	poolBackends := make(map[string][]BackendPort)
+	for _, backend := range config.Backend {
+		poolBackends[backend.poolName()] = append(poolBackends[backend.poolName()], backend)
+	}
+	old, _ := ph.routes.Load().(*routeTable)
+	table := &routeTable{
+		pools:     make(map[string]*backendPool),
+		byBackend: make(map[string]*backendPool, len(config.Backend)),
+	}
+	for name, poolConfig := range config.poolConfigs() {
+		var previous *backendPool
+		if old != nil {
+			previous = old.pools[name]
+		}
+		pool, err := ph.newBackendPool(poolConfig, poolBackends[name], previous)
+		if err != nil {
+			return err
+		}
+		table.pools[name] = pool
+		for _, backend := range pool.backends {
+			table.byBackend[backend.Name] = pool
+		}
+	}
+	table.fallback = &route{name: DefaultPool, pool: table.pools[DefaultPool]}
+	for _, routeConfig := range config.Routes {
+		r, err := newRoute(routeConfig, table.pools[routeConfig.Pool])
+		if err != nil || r.pool == nil {
+			// routes are validated when the config is parsed
+			log.Printf("Skipping invalid route to pool %v: %v\n", routeConfig.Pool, err)
+			continue
+		}
+		table.routes = append(table.routes, r)
+	}
+	for _, name := range unhealthy {
+		if pool, ok := table.byBackend[name]; ok {
+			pool.lb.MarkUnhealthy(pool.ids[name])
+		}
+	}
+	for _, name := range downPools {
+		if pool, ok := table.pools[name]; ok {
+			pool.down = 1
+		}
+	}
+
+	ph.routes.Store(table)
+	if old != nil {
+		for _, pool := range old.pools {
+			pool.closeIdleConnections()
+		}
+	}
+	return nil
+}
+
+// newBackendPool builds the load balancer, proxies and transports of a pool.
+// The backends keep the load balancer state they had in previous, the pool
+// it replaces if any, and the weight set at runtime unless their configured
+// weight changed
+func (ph *proxyHandler) newBackendPool(config PoolConfig, backends []BackendPort, previous *backendPool) (*backendPool, error) {
+	downstreams := make([]loadbalancer.DownstreamConfig, len(backends))
+	for i, backend := range backends {
+		downstreams[i] = loadbalancer.DownstreamConfig{Name: backend.Name, Weight: backend.Weight}
+	}
+	var previousLB loadbalancer.LoadBalancer
+	var previousIDs map[string]uint16
+	if previous != nil {
+		previousLB, previousIDs = previous.lb, previous.ids
+		weighted, ok := previous.lb.(loadbalancer.WeightedLoadBalancer)
+		for i, backend := range backends {
+			if id, found := previous.ids[backend.Name]; ok && found && previous.backends[id].Weight == backend.Weight {
+				downstreams[i].Weight = weighted.Weight(id)
+			}
+		}
+	}
+	lb, err := loadbalancer.Update(previousLB, previousIDs, config.LBAlgorithm, downstreams)
+	if err != nil {
+		log.Printf("%v, falling back to %v\n", err, loadbalancer.PowerOfTwo)
+		lb, _ = loadbalancer.New(loadbalancer.PowerOfTwo, downstreams)
+	}
+	pool := &backendPool{
+		name:       config.Name,
+		lb:         lb,
+		backends:   backends,
+		proxies:    make([]*httputil.ReverseProxy, len(backends)),
+		transports: make([]*http.Transport, len(backends)),
+		tlsConfigs: make([]*tls.Config, len(backends)),
+		ids:        make(map[string]uint16, len(backends)),
+		hashKey:    config.HashKey,
+	}
+	for i, portConfig := range backends {
+		pool.proxies[i] = newReverseProxy(portConfig)
+		pool.proxies[i].Transport = &proxyTransport{id: uint16(i), ph: ph, pool: pool}
+		pool.proxies[i].ErrorHandler = proxyError
+		pool.ids[portConfig.Name] = uint16(i)
+
+		// the config was valid when parsed, but a file may have gone missing
+		tlsConfig, err := portConfig.clientTLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tls config for backend %v: %v", portConfig.Name, err)
+		}
+		pool.tlsConfigs[i] = tlsConfig
+		pool.transports[i] = ph.newBackendTransport(portConfig, tlsConfig)
+	}
+	return pool, nil
+}
+
+// newReverseProxy builds the reverse proxy of a backend, which rewrites the
+// headers of requests and responses as the request info in their context says
+func newReverseProxy(backend BackendPort) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(backend.URL)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		rewriteRequest(r, backend.Name)
+	}
+	proxy.ModifyResponse = rewriteResponse
+	return proxy
+}
+
+// closeIdleConnections closes the idle connections of the backend
+// transports, requests still in flight on the pool are not affected
+func (pool *backendPool) closeIdleConnections() {
+	for _, transport := range pool.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// setHealth marks the named backend healthy or unhealthy in the current pool
+func (ph *proxyHandler) setHealth(name string, healthy bool) {
+	pool, ok := ph.getRoutes().byBackend[name]
+	if !ok {
+		return
+	}
+	id := pool.ids[name]
+	if healthy {
+		pool.lb.MarkHealthy(id)
+	} else {
+		pool.lb.MarkUnhealthy(id)
+	}
+}
+
+// admit reserves a connection slot, returning false if maxConn has been reached
+func (ph *proxyHandler) admit() bool {
 	for {
 		localCurConn := atomic.LoadUint32(&ph.curConn)
-		if localCurConn >= ph.maxConn {
-			// refuse the connection
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			return
+		if localCurConn >= atomic.LoadUint32(&ph.maxConn) {
+			return false
 		}
 		if atomic.CompareAndSwapUint32(&ph.curConn, localCurConn, localCurConn+1) {
-			break
+			return true
+		}
+	}
+}
+
+// SetWeight changes the weight of the named backend until a reload changes
+// its configured weight, which like in the config can be at most
+// loadbalancer.MaxWeight
+func (proxyServer *ProxyServer) SetWeight(name string, weight uint32) error {
+	if weight > loadbalancer.MaxWeight {
+		return fmt.Errorf("Weight of backend %q is over %v: %v", name, loadbalancer.MaxWeight, weight)
+	}
+	pool, ok := proxyServer.ph.getRoutes().byBackend[name]
+	if !ok {
+		return fmt.Errorf("Unknown backend: %q", name)
+	}
+	id := pool.ids[name]
+	lb, ok := pool.lb.(loadbalancer.WeightedLoadBalancer)
+	if !ok {
+		return fmt.Errorf("Load balancer does not support weights")
+	}
+	return lb.SetWeight(id, weight)
+}
+
+func (ph *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tStart := time.Now()
+	info := newRequestInfo(r, ph.getHeaderPolicy())
+	r = withRequestInfo(r, info)
+	if accessLog := ph.getAccessLog(); accessLog != nil && accessLog.sample() {
+		recorder := &responseRecorder{ResponseWriter: w}
+		body := &countingBody{}
+		if r.Body != nil && r.Body != http.NoBody {
+			body.ReadCloser = r.Body
+			r.Body = body
 		}
+		w = recorder
+		request := r
+		defer func() {
+			accessLog.log(accessLogEntry{start: tStart, server: ph.name, request: request, info: info, bytesIn: body.read, response: recorder})
+		}()
+	}
+	if ph.isDraining() {
+		ph.serveDraining(w)
+		return
+	}
+	limits := ph.getServerLimits()
+	requestLimits := limits.forPath(r.URL.Path)
+	if !limitRequest(w, r, requestLimits, limits.readTimeout) {
+		return
+	}
+	route := ph.getRoutes().route(r)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+	info.route = route
+	pool := route.pool
+	if pool.isDown() || len(pool.backends) == 0 || !ph.acquire(r) {
+		// refuse the connection
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
 
-	id := ph.lb.GetDownstream()
-	ph.lb.IncConn(id)
+	if ph.shutdownMode == ShutdownModeDrain {
+		ctx, cancel := ph.withDrainDeadline(r.Context())
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	// routes with a shorter write timeout than the server get a deadline
+	if requestLimits.writeTimeout < limits.writeTimeout {
+		ctx, cancel := context.WithTimeout(r.Context(), requestLimits.writeTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if policy := ph.getRetryPolicy(); policy.config.enabled() {
+		policy.deposit()
+		if err := bufferBody(r, policy.config.MaxBodySize); err != nil {
+			ph.release()
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			switch err {
+			case errBodyTooLarge:
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			case errReadTimeout:
+				w.WriteHeader(http.StatusRequestTimeout)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+	}
+
+	id := pool.lb.GetDownstream(loadbalancer.WithHashKey(r.Context(), requestHashKey(pool.hashKey, r)))
+	pool.lb.IncConn(id)
 
 	//proxy := httputil.NewSingleHostReverseProxy(ph.backends[id].URL)
 	serveTimeNS := time.Since(tStart).Nanoseconds()
-	ph.proxies[id].ServeHTTP(w, r)
+	pool.proxies[id].ServeHTTP(w, r)
 	ph.metrics.handleTimeNS.With(prometheus.Labels{"server": ph.name}).Observe(float64(serveTimeNS))
 }
 
 type proxyTransport struct {
-	ph *proxyHandler
-	id uint16
+	ph   *proxyHandler
+	pool *backendPool
+	id   uint16
 }
 
+// RoundTrip sends the request to the backend of the transport, and retries
+// it on other backends as allowed by the retry policy
 func (pt *proxyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	pt.ph.metrics.httpRequests.With(prometheus.Labels{"server": pt.ph.name}).Inc()
-	pt.ph.metrics.numActiveConnections.With(prometheus.Labels{"backend": pt.ph.backends[pt.id].Name}).Inc()
-	response, err := http.DefaultTransport.RoundTrip(request)
+	pt.ph.metrics.httpRequests.With(prometheus.Labels{"server": pt.ph.name, "pool": pt.pool.name}).Inc()
+	defer pt.ph.release()
 
-	defer func() {
-		pt.ph.lb.DecConn(pt.id)
-		atomic.AddUint32(&pt.ph.curConn, ^uint32(0))
-	}()
+	policy := pt.ph.getRetryPolicy()
+	id := pt.id
+	tried := map[uint16]bool{}
+	for attempt := 1; ; attempt++ {
+		tried[id] = true
+		response, err := pt.roundTrip(id, request)
 
-	if err != nil {
-		return nil, err
+		next, ok := pt.retryBackend(policy, attempt, request, response, err, tried)
+		var retry *http.Request
+		if ok {
+			retry, ok = retryRequest(request, pt.pool.backends[next].URL)
+		}
+		if ok {
+			rewriteRetry(retry, pt.pool.backends[next].Name)
+		}
+		if !ok {
+			if err != nil {
+				return nil, err
+			}
+			pt.ph.metrics.httpResponses.With(prometheus.Labels{"server": pt.ph.name, "pool": pt.pool.name, "code": fmt.Sprintf("%vxx", response.StatusCode/100)}).Inc()
+			return response, nil
+		}
+
+		if response != nil {
+			response.Body.Close()
+		}
+		pt.pool.lb.IncConn(next)
+		request, id = retry, next
 	}
+}
+
+// roundTrip makes a single attempt on a backend, and releases the connection
+// the caller counted against it once done
+func (pt *proxyTransport) roundTrip(id uint16, request *http.Request) (*http.Response, error) {
+	defer pt.pool.lb.DecConn(id)
+	backendLabel := prometheus.Labels{"server": pt.ph.name, "backend": pt.pool.backends[id].Name}
+	pt.ph.metrics.numActiveConnections.With(backendLabel).Inc()
+	defer pt.ph.metrics.numActiveConnections.With(backendLabel).Dec()
+	defer pt.ph.trackConnection(backendLabel["backend"])()
+
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			pt.ph.metrics.backendConnsAcquired.With(prometheus.Labels{"server": pt.ph.name, "backend": backendLabel["backend"], "reused": strconv.FormatBool(info.Reused)}).Inc()
+		},
+	}))
 
-	pt.ph.metrics.numActiveConnections.With(prometheus.Labels{"backend": pt.ph.backends[pt.id].Name}).Dec()
-	pt.ph.metrics.httpResponses.With(prometheus.Labels{"server": pt.ph.name, "code": fmt.Sprintf("%vxx", response.StatusCode/100)}).Inc()
+	info := getRequestInfo(request.Context())
+	routeName := ""
+	if info != nil && info.route != nil {
+		routeName = info.route.name
+	}
+	sentLabels := prometheus.Labels{"server": pt.ph.name, "backend": backendLabel["backend"]}
+	if request.Body != nil && request.Body != http.NoBody {
+		request.Body = &meteredBody{ReadCloser: request.Body, done: func(n int64) {
+			pt.ph.metrics.backendSentBytes.With(sentLabels).Add(float64(n))
+		}}
+	}
+
+	tStart := time.Now()
+	response, err := pt.pool.transports[id].RoundTrip(request)
+	if info != nil {
+		info.attempts++
+		info.upstreamLatency += time.Since(tStart)
+	}
+	pt.observeAttempt(request, backendLabel["backend"], routeName, tStart, response, err)
+	if observer, ok := pt.pool.lb.(loadbalancer.LatencyObserver); ok && err == nil {
+		observer.ObserveLatency(id, time.Since(tStart))
+	}
+	// requests cancelled by the client say nothing about the backend
+	if pt.ph.outliers != nil && request.Context().Err() == nil {
+		pt.ph.outliers.record(pt.pool.backends[id].Name, err == nil && response.StatusCode < 500)
+	}
 	return response, err
 }
+
+// observeAttempt counts an attempt on a backend and observes its latencies.
+// The duration of a response is observed once its body is closed, which the
+// reverse proxy does once it was copied to the client
+func (pt *proxyTransport) observeAttempt(request *http.Request, backend, routeName string, tStart time.Time, response *http.Response, err error) {
+	labels := prometheus.Labels{"server": pt.ph.name, "backend": backend, "route": routeName, "code": "error"}
+	if err != nil {
+		pt.ph.metrics.backendErrors.With(prometheus.Labels{"server": pt.ph.name, "backend": backend, "route": routeName, "reason": backendErrorReason(request.Context(), err)}).Inc()
+	} else {
+		labels["code"] = fmt.Sprintf("%vxx", response.StatusCode/100)
+	}
+	pt.ph.metrics.backendRequests.With(labels).Inc()
+	pt.ph.metrics.backendFirstByte.With(labels).Observe(time.Since(tStart).Seconds())
+	// the body of an upgraded connection must stay writable for the reverse
+	// proxy to take it over
+	if err != nil || response.StatusCode == http.StatusSwitchingProtocols {
+		pt.ph.metrics.backendDuration.With(labels).Observe(time.Since(tStart).Seconds())
+		return
+	}
+	receivedLabels := prometheus.Labels{"server": pt.ph.name, "backend": backend}
+	response.Body = &meteredBody{ReadCloser: response.Body, done: func(n int64) {
+		pt.ph.metrics.backendDuration.With(labels).Observe(time.Since(tStart).Seconds())
+		pt.ph.metrics.backendReceivedBytes.With(receivedLabels).Add(float64(n))
+	}}
+}
+
+// backendErrorReason tells why a request to a backend failed without a
+// response
+func backendErrorReason(ctx context.Context, err error) string {
+	if ctx.Err() == context.Canceled {
+		return "canceled"
+	}
+	if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || ctx.Err() == context.DeadlineExceeded {
+		return "timeout"
+	}
+	return "connection"
+}
+
+// meteredBody counts the bytes read off a body, and calls done with their
+// number once it is closed
+type meteredBody struct {
+	io.ReadCloser
+	read int64
+	once sync.Once
+	done func(read int64)
+}
+
+func (body *meteredBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	atomic.AddInt64(&body.read, int64(n))
+	return n, err
+}
+
+func (body *meteredBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(func() { body.done(atomic.LoadInt64(&body.read)) })
+	return err
+}
+
+// retryBackend decides whether the result of an attempt should be retried,
+// and if so picks the backend to retry on. Hashing load balancers pick a
+// random backend for retries
+func (pt *proxyTransport) retryBackend(policy *retryPolicy, attempt int, request *http.Request, response *http.Response, err error, tried map[uint16]bool) (uint16, bool) {
+	reason := policy.retryReason(request, response, err)
+	if reason == "" || attempt >= policy.config.Attempts || request.Context().Err() != nil || !canReplay(request) {
+		return 0, false
+	}
+
+	labels := prometheus.Labels{"server": pt.ph.name, "pool": pt.pool.name, "reason": reason, "result": "retried"}
+	next, ok := pt.nextBackend(request, tried)
+	if !ok {
+		labels["result"] = "no_backend"
+	} else if !policy.withdraw() {
+		labels["result"] = "budget_exhausted"
+		ok = false
+	}
+	pt.ph.metrics.retries.With(labels).Inc()
+	return next, ok
+}
+
+// nextBackend asks the load balancer for a backend that was not tried yet
+func (pt *proxyTransport) nextBackend(request *http.Request, tried map[uint16]bool) (uint16, bool) {
+	for i := 0; i < len(pt.pool.backends); i++ {
+		id := pt.pool.lb.GetDownstream(request.Context())
+		if !tried[id] {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// retryRequest copies a request for another attempt on the target backend
+func retryRequest(request *http.Request, target *url.URL) (*http.Request, bool) {
+	retry := request.WithContext(request.Context())
+	retryURL := *request.URL
+	retryURL.Scheme = target.Scheme
+	retryURL.Host = target.Host
+	retry.URL = &retryURL
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		retry.Body = body
+	}
+	return retry, true
+}
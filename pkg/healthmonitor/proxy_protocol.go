@@ -0,0 +1,323 @@
+package healthmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions backends can be sent
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+// proxyProtocolV2Signature starts every version 2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolConfig accepts PROXY protocol headers on the listener, so the
+// address of the original client replaces the one of the load balancer in
+// front of the proxy. Connections from TrustedCIDRs must start with a
+// version 1 or 2 header, from anywhere else a header is not looked for, so
+// clients cannot spoof their address. Timeout bounds reading the header
+type ProxyProtocolConfig struct {
+	TrustedCIDRs []string      `yaml:"trusted_cidrs"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+func (config *ProxyProtocolConfig) setDefaults() {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultProxyProtocolTimeout
+	}
+}
+
+func (config ProxyProtocolConfig) validate() error {
+	_, err := parseCIDRs(config.TrustedCIDRs)
+	return err
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR: %v", err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolPolicy is the parsed ProxyProtocolConfig of a listener
+type proxyProtocolPolicy struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func (ph *proxyHandler) setProxyProtocolConfig(config ProxyProtocolConfig) {
+	config.setDefaults()
+	// the config was validated when parsed
+	trusted, _ := parseCIDRs(config.TrustedCIDRs)
+	ph.proxyProtocol.Store(&proxyProtocolPolicy{trusted: trusted, timeout: config.Timeout})
+}
+
+func (ph *proxyHandler) getProxyProtocolPolicy() *proxyProtocolPolicy {
+	return ph.proxyProtocol.Load().(*proxyProtocolPolicy)
+}
+
+// proxyProtocolListener reads PROXY protocol headers off the connections it
+// accepts from trusted sources. Headers are read on the first use of a
+// connection rather than in Accept, so a slow client does not hold up others
+type proxyProtocolListener struct {
+	net.Listener
+	ph *proxyHandler
+}
+
+func (listener *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	policy := listener.ph.getProxyProtocolPolicy()
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !containsIP(policy.trusted, addr.IP) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), timeout: policy.timeout}, nil
+}
+
+// proxyProtocolConn reports the addresses from its PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (conn *proxyProtocolConn) readHeader() {
+	conn.once.Do(func() {
+		conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+		conn.remoteAddr, conn.localAddr, conn.err = readProxyHeader(conn.reader)
+		conn.Conn.SetReadDeadline(time.Time{})
+		if conn.err != nil {
+			log.Printf("Invalid PROXY protocol header from %v: %v\n", conn.Conn.RemoteAddr(), conn.err)
+		}
+	})
+}
+
+func (conn *proxyProtocolConn) Read(p []byte) (int, error) {
+	conn.readHeader()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.reader.Read(p)
+}
+
+// RemoteAddr returns the source address of the header, or the address of the
+// peer if the header has none
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	conn.readHeader()
+	if conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header, or the address
+// the connection was accepted on if the header has none
+func (conn *proxyProtocolConn) LocalAddr() net.Addr {
+	conn.readHeader()
+	if conn.localAddr != nil {
+		return conn.localAddr
+	}
+	return conn.Conn.LocalAddr()
+}
+
+func (conn *proxyProtocolConn) CloseWrite() error {
+	if halfCloser, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return conn.Conn.Close()
+}
+
+var errNoProxyHeader = errors.New("Connection does not start with a PROXY protocol header")
+
+// readProxyHeader reads a version 1 or 2 header, the addresses are nil for
+// headers that carry none, like those of health checks
+func readProxyHeader(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(reader)
+	case '\r':
+		return readProxyHeaderV2(reader)
+	}
+	return nil, nil, errNoProxyHeader
+}
+
+// readProxyHeaderV1 reads a header like "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80"
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	// the longest valid header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errNoProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, errNoProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol v1 header: %q", line)
+	}
+	source, err := parseTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func parseTCPAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address in PROXY protocol header: %q", host)
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port in PROXY protocol header: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNumber)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header, skipping its TLVs
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, errNoProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// only the PROXY command over TCP carries addresses we can use, LOCAL
+	// is sent by health checks of the load balancer itself
+	command, family := header[12]&0xf, header[13]
+	if command != 1 {
+		return nil, nil, nil
+	}
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, fmt.Errorf("PROXY protocol v2 header too short for its addresses")
+	}
+	source := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return source, destination, nil
+}
+
+// writeProxyHeader sends a header for a connection from source to
+// destination, a header without addresses if they are not both tcp
+// addresses of the same family
+func writeProxyHeader(w io.Writer, version string, source, destination net.Addr) error {
+	src, srcOK := source.(*net.TCPAddr)
+	dst, dstOK := destination.(*net.TCPAddr)
+	ipv4 := srcOK && dstOK && src.IP.To4() != nil && dst.IP.To4() != nil
+	ipv6 := srcOK && dstOK && src.IP.To4() == nil && dst.IP.To4() == nil
+
+	if version == ProxyProtocolV1 {
+		header := "PROXY UNKNOWN\r\n"
+		if ipv4 {
+			header = fmt.Sprintf("PROXY TCP4 %v %v %v %v\r\n", src.IP, dst.IP, src.Port, dst.Port)
+		} else if ipv6 {
+			header = fmt.Sprintf("PROXY TCP6 %v %v %v %v\r\n", src.IP, dst.IP, src.Port, dst.Port)
+		}
+		_, err := io.WriteString(w, header)
+		return err
+	}
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	var addrs []byte
+	switch {
+	case ipv4:
+		header = append(header, 0x21, 0x11)
+		addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+	case ipv6:
+		header = append(header, 0x21, 0x21)
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	default:
+		// PROXY command with an unspecified family
+		header = append(header, 0x21, 0x00)
+	}
+	if addrs != nil {
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports, uint16(src.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+		addrs = append(addrs, ports...)
+	}
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+	header = append(append(header, length...), addrs...)
+	_, err := w.Write(header)
+	return err
+}
@@ -0,0 +1,170 @@
+package healthmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}
+	server := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 4000}
+	server6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	header := func(version string, source, destination net.Addr) string {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, version, source, destination); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	v2Local := string(proxyProtocolV2Signature) + "\x20\x00\x00\x00"
+
+	for _, test := range []struct {
+		header string
+		source string
+		err    bool
+	}{
+		{"PROXY TCP4 203.0.113.7 198.51.100.1 4000 443\r\n", "203.0.113.7:4000", false},
+		{header(ProxyProtocolV1, client, server), "203.0.113.7:4000", false},
+		{header(ProxyProtocolV1, client6, server6), "[2001:db8::7]:4000", false},
+		{header(ProxyProtocolV2, client, server), "203.0.113.7:4000", false},
+		{header(ProxyProtocolV2, client6, server6), "[2001:db8::7]:4000", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{header(ProxyProtocolV2, client, server6), "", false},
+		{v2Local, "", false},
+		{"PROXY TCP4 203.0.113.7\r\n", "", true},
+		{"PROXY TCP4 203.0.113.7 198.51.100.1 4000 70000\r\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+	} {
+		reader := bufio.NewReader(strings.NewReader(test.header + "payload"))
+		source, _, err := readProxyHeader(reader)
+		if (err != nil) != test.err {
+			t.Errorf("Expected error %v for %q, got %v", test.err, test.header, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if (source == nil && test.source != "") || (source != nil && source.String() != test.source) {
+			t.Errorf("Expected source %q for %q, got %v", test.source, test.header, source)
+		}
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != "payload" {
+			t.Errorf("Expected the header of %q to be consumed, %q is left", test.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocolTCP(t *testing.T) {
+	// the backend expects a v2 header and answers with the source it names
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				source, _, err := readProxyHeader(bufio.NewReader(conn))
+				if err != nil {
+					conn.Write([]byte(err.Error() + "\n"))
+					return
+				}
+				conn.Write([]byte(source.String() + "\n"))
+			}()
+		}
+	}()
+
+	var config Config
+	config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	config.Proxy.Mode = ModeTCP
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "proxy_protocol_tcp_test"
+	config.Proxy.ProxyProtocol.TrustedCIDRs = []string{"127.0.0.0/8"}
+	config.Backend = []BackendPort{{
+		Name:          "server_1",
+		Address:       listener.Addr().String(),
+		ProxyProtocol: ProxyProtocolV2,
+	}}
+	proxy := NewProxyServer(&config)
+	go proxy.Start()
+	defer proxy.shutdown()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", config.Proxy.Bind); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 4000 443\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "203.0.113.7:4000\n" {
+		t.Errorf("Expected the backend to see the client address, got %q", line)
+	}
+}
+
+func TestProxyProtocolHTTP(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "proxy_protocol_http_test"
+	config.Proxy.ProxyProtocol.TrustedCIDRs = []string{"127.0.0.0/8"}
+	config.Backend = []BackendPort{{Name: "server_1", URL: downstreamURL}}
+	proxy := NewProxyServer(&config)
+	go proxy.Start()
+	defer proxy.shutdown()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", config.Proxy.Bind); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeProxyHeader(conn, ProxyProtocolV2, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}, conn.RemoteAddr())
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "203.0.113.7" {
+		t.Errorf("Expected the client address to be forwarded, got %q", body)
+	}
+}
@@ -1,6 +1,10 @@
 package healthmonitor
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -19,3 +23,38 @@ func TestBasicProxyServer(t *testing.T) {
 		go proxy.stop()
 	}
 }
+
+func TestMultipleFrontends(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	for _, name := range []string{"frontend_1", "frontend_2"} {
+		var config Config
+		config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+		config.Proxy.MaxConn = 10
+		config.Proxy.Name = name
+		config.Backend = []BackendPort{{Name: "server_1", URL: downstreamURL}}
+
+		proxy := NewProxyServer(&config)
+		NewHealthMonitor(&config, proxy)
+		go proxy.Start()
+		defer proxy.shutdown()
+
+		var response *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if response, err = http.Get("http://" + config.Proxy.Bind + "/"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 from %v, got %v", name, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package healthmonitor
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Orders in which queued requests are admitted
+const (
+	QueueFIFO = "fifo"
+	QueueLIFO = "lifo"
+)
+
+const defaultQueueTimeout = time.Second
+
+// QueueConfig lets requests that arrive while max_conn requests are in flight
+// wait for a slot instead of being refused right away. Up to MaxLength
+// requests wait for at most Timeout each, and are admitted oldest first for
+// fifo or newest first for lifo. If PriorityHeader is set, requests with a
+// higher integer value in it are admitted first. A MaxLength of 0 disables
+// queueing
+type QueueConfig struct {
+	MaxLength      int           `yaml:"max_length"`
+	Timeout        time.Duration `yaml:"timeout"`
+	Order          string        `yaml:"order"`
+	PriorityHeader string        `yaml:"priority_header"`
+}
+
+func (config *QueueConfig) setDefaults() {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultQueueTimeout
+	}
+	if config.Order == "" {
+		config.Order = QueueFIFO
+	}
+}
+
+func (config QueueConfig) validate() error {
+	if config.MaxLength < 0 {
+		return fmt.Errorf("Invalid queue max_length: %v", config.MaxLength)
+	}
+	if config.Order != QueueFIFO && config.Order != QueueLIFO {
+		return fmt.Errorf("Invalid queue order: %q", config.Order)
+	}
+	return nil
+}
+
+// waiter is a request waiting in the queue, ready is signalled once it has
+// been handed a connection slot
+type waiter struct {
+	priority int
+	ready    chan struct{}
+}
+
+// requestQueue hands the connection slots of finished requests to the
+// requests waiting for one
+type requestQueue struct {
+	config  atomic.Value // QueueConfig
+	mu      sync.Mutex
+	waiters []*waiter
+}
+
+func (ph *proxyHandler) setQueueConfig(config QueueConfig) {
+	config.setDefaults()
+	ph.queue.config.Store(config)
+	// a higher max_conn may have freed slots for the waiters
+	ph.fillQueue()
+}
+
+func (ph *proxyHandler) getQueueConfig() QueueConfig {
+	return ph.queue.config.Load().(QueueConfig)
+}
+
+// acquire reserves a connection slot, waiting in the queue for one if
+// max_conn has been reached. It returns false if the request has to be
+// refused
+func (ph *proxyHandler) acquire(r *http.Request) bool {
+	config := ph.getQueueConfig()
+	if config.MaxLength == 0 {
+		return ph.admit()
+	}
+
+	labels := prometheus.Labels{"server": ph.name, "result": "full"}
+	q := &ph.queue
+	q.mu.Lock()
+	// requests do not get ahead of those already waiting
+	if len(q.waiters) == 0 && ph.admit() {
+		q.mu.Unlock()
+		return true
+	}
+	if len(q.waiters) >= config.MaxLength {
+		q.mu.Unlock()
+		ph.metrics.queuedRequests.With(labels).Inc()
+		return false
+	}
+	w := &waiter{ready: make(chan struct{}, 1)}
+	if config.PriorityHeader != "" {
+		w.priority, _ = strconv.Atoi(r.Header.Get(config.PriorityHeader))
+	}
+	q.waiters = append(q.waiters, w)
+	ph.metrics.queueLength.With(prometheus.Labels{"server": ph.name}).Set(float64(len(q.waiters)))
+	q.mu.Unlock()
+
+	tStart := time.Now()
+	timer := time.NewTimer(config.Timeout)
+	defer timer.Stop()
+	admitted := false
+	select {
+	case <-w.ready:
+		labels["result"] = "admitted"
+		admitted = true
+	case <-timer.C:
+		labels["result"] = "timeout"
+	case <-r.Context().Done():
+		labels["result"] = "cancelled"
+	}
+	if !admitted && !ph.leaveQueue(w) {
+		// the slot was handed over as the wait ended
+		<-w.ready
+		if labels["result"] == "cancelled" {
+			ph.release()
+		} else {
+			labels["result"] = "admitted"
+			admitted = true
+		}
+	}
+	ph.metrics.queuedRequests.With(labels).Inc()
+	ph.metrics.queueWaitSeconds.With(prometheus.Labels{"server": ph.name}).Observe(time.Since(tStart).Seconds())
+	return admitted
+}
+
+// leaveQueue takes a waiter out of the queue, returning false if it was not
+// in it anymore
+func (ph *proxyHandler) leaveQueue(w *waiter) bool {
+	q := &ph.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.waiters {
+		if queued == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			ph.metrics.queueLength.With(prometheus.Labels{"server": ph.name}).Set(float64(len(q.waiters)))
+			return true
+		}
+	}
+	return false
+}
+
+// release frees a connection slot, handing it to the next waiter if any.
+// Slots are not handed over while a lowered max_conn is exceeded
+func (ph *proxyHandler) release() {
+	if ph.getQueueConfig().MaxLength == 0 {
+		atomic.AddUint32(&ph.curConn, ^uint32(0))
+		return
+	}
+	q := &ph.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiters) > 0 && atomic.LoadUint32(&ph.curConn) <= atomic.LoadUint32(&ph.maxConn) {
+		ph.admitNext()
+		return
+	}
+	atomic.AddUint32(&ph.curConn, ^uint32(0))
+}
+
+// fillQueue admits waiters while there are free slots
+func (ph *proxyHandler) fillQueue() {
+	q := &ph.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.waiters) > 0 && ph.admit() {
+		ph.admitNext()
+	}
+}
+
+// admitNext hands a slot to the waiter with the highest priority, the oldest
+// or newest of them depending on the order. It is called with the lock held
+// and at least one waiter queued
+func (ph *proxyHandler) admitNext() {
+	q := &ph.queue
+	lifo := ph.getQueueConfig().Order == QueueLIFO
+	best := 0
+	for i, w := range q.waiters {
+		if w.priority > q.waiters[best].priority || (lifo && w.priority == q.waiters[best].priority) {
+			best = i
+		}
+	}
+	w := q.waiters[best]
+	q.waiters = append(q.waiters[:best], q.waiters[best+1:]...)
+	ph.metrics.queueLength.With(prometheus.Labels{"server": ph.name}).Set(float64(len(q.waiters)))
+	w.ready <- struct{}{}
+}
@@ -0,0 +1,122 @@
+package healthmonitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRequestQueue(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-unblock
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.MaxConn = 1
+	config.Proxy.Name = "queue_test"
+	config.Proxy.Queue = QueueConfig{MaxLength: 1, Timeout: 5 * time.Second}
+	config.Backend = []BackendPort{{Name: "server_1", URL: downstreamURL}}
+	proxy := NewProxyServer(&config)
+
+	serve := func() <-chan int {
+		code := make(chan int, 1)
+		go func() {
+			recorder := httptest.NewRecorder()
+			proxy.ph.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+			code <- recorder.Code
+		}()
+		return code
+	}
+	queued := func() int {
+		proxy.ph.queue.mu.Lock()
+		defer proxy.ph.queue.mu.Unlock()
+		return len(proxy.ph.queue.waiters)
+	}
+	waitQueued := func(n int) {
+		for i := 0; i < 100 && queued() != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if queued() != n {
+			t.Fatalf("Expected %v queued requests, got %v", n, queued())
+		}
+	}
+
+	first := serve()
+	<-arrived
+	second := serve()
+	waitQueued(1)
+	if code := <-serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a request to be refused with a full queue, got %v", code)
+	}
+
+	// the slot of the first request is handed to the second
+	unblock <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("Expected the first request to succeed, got %v", code)
+	}
+	<-arrived
+	waitQueued(0)
+	unblock <- struct{}{}
+	if code := <-second; code != http.StatusOK {
+		t.Errorf("Expected the queued request to succeed, got %v", code)
+	}
+
+	// requests give up once the timeout expires
+	proxy.ph.setQueueConfig(QueueConfig{MaxLength: 1, Timeout: 50 * time.Millisecond})
+	third := serve()
+	<-arrived
+	if code := <-serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a request to be refused after waiting, got %v", code)
+	}
+	waitQueued(0)
+	unblock <- struct{}{}
+	<-third
+
+	if curConn := proxy.ph.curConn; curConn != 0 {
+		t.Errorf("Expected no active connections, got %v", curConn)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	for _, test := range []struct {
+		config     QueueConfig
+		priorities []int
+		expected   []int
+	}{
+		{QueueConfig{Order: QueueFIFO}, []int{0, 0, 0}, []int{0, 1, 2}},
+		{QueueConfig{Order: QueueLIFO}, []int{0, 0, 0}, []int{2, 1, 0}},
+		{QueueConfig{Order: QueueFIFO}, []int{0, 5, 1, 5}, []int{1, 3, 2, 0}},
+		{QueueConfig{Order: QueueLIFO}, []int{0, 5, 1, 5}, []int{3, 1, 2, 0}},
+	} {
+		ph := &proxyHandler{metrics: NewProxyHandlerMetrics(), name: "queue_order_test"}
+		ph.setQueueConfig(test.config)
+		waiters := make([]*waiter, len(test.priorities))
+		for i, priority := range test.priorities {
+			waiters[i] = &waiter{priority: priority, ready: make(chan struct{}, 1)}
+		}
+		ph.queue.waiters = append([]*waiter(nil), waiters...)
+
+		var order []int
+		for range waiters {
+			ph.admitNext()
+			for i, w := range waiters {
+				select {
+				case <-w.ready:
+					order = append(order, i)
+				default:
+				}
+			}
+		}
+		if !reflect.DeepEqual(order, test.expected) {
+			t.Errorf("Expected %v to admit %v, got %v", test.config.Order, test.expected, order)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package healthmonitor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	defaultRetryBudgetPercent = 20
+	defaultRetryMaxBodySize   = 64 << 10
+	// maxRetryBudget is the most retries that can be saved up, it is also
+	// the budget a policy starts out with
+	maxRetryBudget = 10
+	// minRetryBudgetPercent is the smallest share of a retry the budget
+	// counts, which is a thousandth
+	minRetryBudgetPercent = 0.1
+)
+
+// RetryConfig configures retrying failed requests on another backend.
+// Attempts is the most times a request is tried, a value of 1 or less
+// disables retries. Connection errors are always retried, responses with one
+// of StatusCodes only for idempotent methods. Retries are limited to
+// BudgetPercent of the requests, which is at least 0.1 and is kept across
+// reloads, and request bodies larger than MaxBodySize
+// are streamed instead of buffered so those requests are not retried
+type RetryConfig struct {
+	Attempts      int     `yaml:"attempts"`
+	StatusCodes   []int   `yaml:"status_codes"`
+	BudgetPercent float64 `yaml:"budget_percent"`
+	MaxBodySize   int64   `yaml:"max_body_size"`
+}
+
+func (config RetryConfig) enabled() bool {
+	return config.Attempts > 1
+}
+
+func (config *RetryConfig) setDefaults() {
+	if config.BudgetPercent <= 0 {
+		config.BudgetPercent = defaultRetryBudgetPercent
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultRetryMaxBodySize
+	}
+}
+
+func (config RetryConfig) validate() error {
+	if config.BudgetPercent < minRetryBudgetPercent {
+		return fmt.Errorf("Retry budget_percent must be at least %v: %v", minRetryBudgetPercent, config.BudgetPercent)
+	}
+	for _, code := range config.StatusCodes {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("Invalid retry status code: %v", code)
+		}
+	}
+	return nil
+}
+
+// retryPolicy is a RetryConfig along with its retry budget
+type retryPolicy struct {
+	config      RetryConfig
+	statusCodes map[int]bool
+	// budget counts thousandths of a retry, every request earns
+	// BudgetPercent of a retry and every retry spends a whole one. It is
+	// shared with the policy this one replaced, so a reload does not refill it
+	budget *int64
+}
+
+// newRetryPolicy makes a retryPolicy that takes over the budget of previous,
+// or starts with a full budget if previous is nil
+func newRetryPolicy(config RetryConfig, previous *retryPolicy) *retryPolicy {
+	config.setDefaults()
+	policy := &retryPolicy{
+		config:      config,
+		statusCodes: make(map[int]bool, len(config.StatusCodes)),
+	}
+	if previous != nil {
+		policy.budget = previous.budget
+	} else {
+		budget := int64(maxRetryBudget * 1000)
+		policy.budget = &budget
+	}
+	for _, code := range config.StatusCodes {
+		policy.statusCodes[code] = true
+	}
+	return policy
+}
+
+// deposit adds the share of a retry earned by a request to the budget
+func (policy *retryPolicy) deposit() {
+	earned := int64(math.Round(policy.config.BudgetPercent * 10))
+	for {
+		budget := atomic.LoadInt64(policy.budget)
+		if budget >= maxRetryBudget*1000 {
+			return
+		}
+		next := budget + earned
+		if next > maxRetryBudget*1000 {
+			next = maxRetryBudget * 1000
+		}
+		if atomic.CompareAndSwapInt64(policy.budget, budget, next) {
+			return
+		}
+	}
+}
+
+// withdraw spends a retry, returning false if the budget is exhausted
+func (policy *retryPolicy) withdraw() bool {
+	for {
+		budget := atomic.LoadInt64(policy.budget)
+		if budget < 1000 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(policy.budget, budget, budget-1000) {
+			return true
+		}
+	}
+}
+
+// retryReason returns why the result of an attempt should be retried, or an
+// empty string if it should not be
+func (policy *retryPolicy) retryReason(request *http.Request, response *http.Response, err error) string {
+	if err != nil {
+		if isConnectError(err) {
+			return "connect_error"
+		}
+		return ""
+	}
+	if policy.statusCodes[response.StatusCode] && isIdempotent(request.Method) {
+		return "status"
+	}
+	return ""
+}
+
+// isConnectError returns true for errors where the request never made it to
+// the backend, which makes them safe to retry for any method
+func isConnectError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// canReplay returns true if the body of a request can be sent again
+func canReplay(request *http.Request) bool {
+	return request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+}
+
+// bufferBody reads a request body of up to limit bytes into memory so that it
+// can be replayed on retries. Larger bodies are left to stream
+func bufferBody(r *http.Request, limit int64) error {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength > limit {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		// put back what was read in front of the rest
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+func (ph *proxyHandler) setRetryConfig(config RetryConfig) {
+	previous, _ := ph.retry.Load().(*retryPolicy)
+	ph.retry.Store(newRetryPolicy(config, previous))
+}
+
+func (ph *proxyHandler) getRetryPolicy() *retryPolicy {
+	return ph.retry.Load().(*retryPolicy)
+}
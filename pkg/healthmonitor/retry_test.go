@@ -0,0 +1,108 @@
+package healthmonitor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wish/tcp-mux-proxy/pkg/loadbalancer"
+)
+
+func TestRetries(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer healthy.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "retry_test"
+	config.Proxy.LBAlgorithm = loadbalancer.RoundRobin
+	config.Proxy.Retry = RetryConfig{Attempts: 3, StatusCodes: []int{http.StatusServiceUnavailable}}
+	for i, target := range []string{"http://127.0.0.1:" + strconv.Itoa(freePort(t)), healthy.URL, unavailable.URL} {
+		targetURL, _ := url.Parse(target)
+		config.Backend = append(config.Backend, BackendPort{Name: "server_" + strconv.Itoa(i), URL: targetURL})
+	}
+	proxy := NewProxyServer(&config)
+
+	serve := func(method, body string) (int, string) {
+		recorder := httptest.NewRecorder()
+		proxy.ph.ServeHTTP(recorder, httptest.NewRequest(method, "/", strings.NewReader(body)))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	// round robin hands out the refused, healthy and unavailable backends in
+	// turn, both to requests and to their retries
+	steps := []struct {
+		method string
+		code   int
+	}{
+		// refused, healthy
+		{http.MethodPost, http.StatusOK},
+		// unavailable, not retried for a POST
+		{http.MethodPost, http.StatusServiceUnavailable},
+		// refused, healthy
+		{http.MethodGet, http.StatusOK},
+		// unavailable, refused, healthy
+		{http.MethodGet, http.StatusOK},
+	}
+	for i, step := range steps {
+		code, body := serve(step.method, "payload")
+		if code != step.code {
+			t.Errorf("Step %v: expected status %v, got %v", i, step.code, code)
+		}
+		if code == http.StatusOK && body != "payload" {
+			t.Errorf("Step %v: expected the body to be replayed, got %q", i, body)
+		}
+	}
+
+	// unavailable, refused and out of attempts
+	proxy.ph.setRetryConfig(RetryConfig{Attempts: 2, StatusCodes: []int{http.StatusServiceUnavailable}})
+	if code, _ := serve(http.MethodGet, ""); code != http.StatusBadGateway {
+		t.Errorf("Expected status 502 after the last attempt, got %v", code)
+	}
+
+	if curConn := proxy.ph.curConn; curConn != 0 {
+		t.Errorf("Expected no active connections, got %v", curConn)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	policy := newRetryPolicy(RetryConfig{Attempts: 2, BudgetPercent: 50}, nil)
+	for i := 0; i < maxRetryBudget; i++ {
+		if !policy.withdraw() {
+			t.Fatalf("Expected retry %v to be in the budget", i)
+		}
+	}
+	if policy.withdraw() {
+		t.Fatal("Expected the budget to be exhausted")
+	}
+	policy.deposit()
+	if policy.withdraw() {
+		t.Error("Expected one request to earn half a retry")
+	}
+	policy.deposit()
+	if !policy.withdraw() {
+		t.Error("Expected two requests to earn a retry")
+	}
+
+	// a reload keeps the exhausted budget instead of refilling it
+	reloaded := newRetryPolicy(RetryConfig{Attempts: 3, BudgetPercent: 50}, policy)
+	if reloaded.withdraw() {
+		t.Error("Expected the budget to stay exhausted across a reload")
+	}
+	reloaded.deposit()
+	policy.deposit()
+	if !reloaded.withdraw() {
+		t.Error("Expected requests on both policies to earn a retry")
+	}
+}
@@ -0,0 +1,283 @@
+package healthmonitor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultPool is the pool of the backends that do not name one. It is
+// configured by the proxy section, and requests no route matches go to it
+const DefaultPool = "default"
+
+// PoolConfig configures a named group of backends. LBAlgorithm and HashKey
+// default to those of the proxy. MinAlive works like the one of the proxy,
+// except that an unhealthy pool answers 503 while the others keep serving,
+// only the default pool takes the whole server down
+type PoolConfig struct {
+	Name        string        `yaml:"name"`
+	LBAlgorithm string        `yaml:"lb_algorithm"`
+	HashKey     HashKeyConfig `yaml:"hash_key"`
+	MinAlive    int           `yaml:"min_alive"`
+}
+
+// RouteConfig sends the requests it matches to a pool. Every condition that
+// is set has to match: the host is one of Hosts, where "*.example.com"
+// matches any subdomain, the path starts with PathPrefix and matches
+// PathRegex, the method is one of Methods, each header in Headers is
+// present with a value matching its regular expression, and the client
+// address is in one of SourceCIDRs. The first route that matches a request
+// wins. RequestHeaders and ResponseHeaders rewrite the headers of the
+// requests it matches, after the rules of the proxy. Name labels the metrics
+// of the requests it matches, it defaults to the name of its pool
+type RouteConfig struct {
+	Name            string            `yaml:"name"`
+	Hosts           []string          `yaml:"hosts"`
+	PathPrefix      string            `yaml:"path_prefix"`
+	PathRegex       string            `yaml:"path_regex"`
+	Methods         []string          `yaml:"methods"`
+	Headers         map[string]string `yaml:"headers"`
+	SourceCIDRs     []string          `yaml:"source_cidrs"`
+	Pool            string            `yaml:"pool"`
+	RequestHeaders  HeaderRules       `yaml:"request_headers"`
+	ResponseHeaders HeaderRules       `yaml:"response_headers"`
+}
+
+// poolName returns the pool of a backend
+func (backend BackendPort) poolName() string {
+	if backend.Pool == "" {
+		return DefaultPool
+	}
+	return backend.Pool
+}
+
+// poolConfigs returns the config of every pool by name, the default pool
+// included
+func (config *Config) poolConfigs() map[string]PoolConfig {
+	pools := map[string]PoolConfig{
+		DefaultPool: {
+			Name:        DefaultPool,
+			LBAlgorithm: config.Proxy.LBAlgorithm,
+			HashKey:     config.Proxy.HashKey,
+			MinAlive:    config.Proxy.MinAlive,
+		},
+	}
+	for _, pool := range config.Pools {
+		if pool.LBAlgorithm == "" {
+			pool.LBAlgorithm = config.Proxy.LBAlgorithm
+		}
+		if pool.HashKey.Source == "" {
+			pool.HashKey = config.Proxy.HashKey
+		}
+		pools[pool.Name] = pool
+	}
+	return pools
+}
+
+// validateRouting checks pools and routes once the backends are parsed
+func (config *Config) validateRouting() error {
+	if config.Proxy.Mode == ModeTCP && (len(config.Pools) > 0 || len(config.Routes) > 0) {
+		return fmt.Errorf("tcp mode does not support pools and routes")
+	}
+
+	sizes := map[string]int{DefaultPool: 0}
+	for _, pool := range config.Pools {
+		if pool.Name == "" || pool.Name == DefaultPool {
+			return fmt.Errorf("Invalid pool name: %q", pool.Name)
+		}
+		if _, ok := sizes[pool.Name]; ok {
+			return fmt.Errorf("Duplicate pool name: %q", pool.Name)
+		}
+		sizes[pool.Name] = 0
+	}
+	for _, backend := range config.Backend {
+		if _, ok := sizes[backend.poolName()]; !ok {
+			return fmt.Errorf("Unknown pool %q for backend %q", backend.Pool, backend.Name)
+		}
+		sizes[backend.poolName()]++
+	}
+	for name, pool := range config.poolConfigs() {
+		if err := pool.HashKey.validate(config.Proxy.Mode); err != nil {
+			return fmt.Errorf("Invalid hash_key for pool %q: %v", name, err)
+		}
+		// the default pool may be left empty when every backend has a pool
+		if sizes[name] == 0 && name != DefaultPool {
+			return fmt.Errorf("Pool %q has no backends", name)
+		}
+		if pool.MinAlive > sizes[name] {
+			return fmt.Errorf("min_alive (%v) of pool %q is greater than the number of its backends (%v)", pool.MinAlive, name, sizes[name])
+		}
+	}
+
+	for i, route := range config.Routes {
+		if _, ok := sizes[route.Pool]; !ok {
+			return fmt.Errorf("Unknown pool %q for route %v", route.Pool, i)
+		}
+		if _, err := newRoute(route, nil); err != nil {
+			return fmt.Errorf("Invalid route %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// route is a compiled RouteConfig
+type route struct {
+	name       string
+	hosts      []string
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	methods    map[string]bool
+	headers    map[string]*regexp.Regexp
+	sources    []*net.IPNet
+	pool       *backendPool
+
+	requestHeaders  *headerRules
+	responseHeaders *headerRules
+}
+
+func newRoute(config RouteConfig, pool *backendPool) (*route, error) {
+	r := &route{name: config.Name, pathPrefix: config.PathPrefix, pool: pool}
+	if r.name == "" {
+		r.name = config.Pool
+	}
+	for _, host := range config.Hosts {
+		r.hosts = append(r.hosts, normalizeHost(host))
+	}
+	if config.PathRegex != "" {
+		pathRegex, err := regexp.Compile(config.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+		r.pathRegex = pathRegex
+	}
+	if len(config.Methods) > 0 {
+		r.methods = make(map[string]bool, len(config.Methods))
+		for _, method := range config.Methods {
+			r.methods[strings.ToUpper(method)] = true
+		}
+	}
+	if len(config.Headers) > 0 {
+		r.headers = make(map[string]*regexp.Regexp, len(config.Headers))
+		for name, value := range config.Headers {
+			valueRegex, err := regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+			r.headers[http.CanonicalHeaderKey(name)] = valueRegex
+		}
+	}
+	if len(config.SourceCIDRs) > 0 {
+		sources, err := parseCIDRs(config.SourceCIDRs)
+		if err != nil {
+			return nil, err
+		}
+		r.sources = sources
+	}
+	var err error
+	if r.requestHeaders, err = compileHeaderRules(config.RequestHeaders); err != nil {
+		return nil, err
+	}
+	if r.responseHeaders, err = compileHeaderRules(config.ResponseHeaders); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// normalizeHost strips the port and trailing dot of a host and lowercases it
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (r *route) matches(request *http.Request, host string) bool {
+	if len(r.hosts) > 0 && !matchHost(r.hosts, host) {
+		return false
+	}
+	if !strings.HasPrefix(request.URL.Path, r.pathPrefix) {
+		return false
+	}
+	if r.pathRegex != nil && !r.pathRegex.MatchString(request.URL.Path) {
+		return false
+	}
+	if r.methods != nil && !r.methods[request.Method] {
+		return false
+	}
+	for name, valueRegex := range r.headers {
+		if !matchHeader(request.Header[name], valueRegex) {
+			return false
+		}
+	}
+	if r.sources != nil && !containsIP(r.sources, net.ParseIP(clientIP(request.RemoteAddr))) {
+		return false
+	}
+	return true
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHeader(values []string, valueRegex *regexp.Regexp) bool {
+	for _, value := range values {
+		if valueRegex.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTable is a snapshot of the pools and the routes to them. Reloading the
+// config swaps in a new table, while requests already in flight finish on
+// the pool they were admitted with
+type routeTable struct {
+	routes []*route
+	// fallback sends the requests no route matches to the default pool
+	fallback *route
+	pools    map[string]*backendPool
+	// byBackend is the pool of each backend by name
+	byBackend map[string]*backendPool
+}
+
+// route returns the route of a request, nil if no route matches and the
+// default pool has no backends
+func (table *routeTable) route(request *http.Request) *route {
+	host := normalizeHost(request.Host)
+	for _, r := range table.routes {
+		if r.matches(request, host) {
+			return r
+		}
+	}
+	if len(table.fallback.pool.backends) > 0 {
+		return table.fallback
+	}
+	return nil
+}
+
+// isDown returns true while the pool is unhealthy
+func (pool *backendPool) isDown() bool {
+	return atomic.LoadUint32(&pool.down) == 1
+}
+
+// setPoolDown marks a named pool down or back up in the current route table
+func (ph *proxyHandler) setPoolDown(name string, down bool) {
+	if pool, ok := ph.getRoutes().pools[name]; ok {
+		var value uint32
+		if down {
+			value = 1
+		}
+		atomic.StoreUint32(&pool.down, value)
+	}
+}
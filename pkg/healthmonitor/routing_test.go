@@ -0,0 +1,121 @@
+package healthmonitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRouteTable(t *testing.T) {
+	var config Config
+	config.Pools = []PoolConfig{{Name: "api"}, {Name: "static"}, {Name: "admin"}}
+	config.Routes = []RouteConfig{
+		{Hosts: []string{"admin.example.com"}, Headers: map[string]string{"x-admin-token": "^secret$"}, Pool: "admin"},
+		{Hosts: []string{"*.api.example.com", "api.example.com"}, Methods: []string{"get", "post"}, Pool: "api"},
+		{PathPrefix: "/static/", PathRegex: `\.(css|js)$`, Pool: "static"},
+		{PathPrefix: "/internal/", SourceCIDRs: []string{"192.0.2.0/24"}, Pool: "admin"},
+	}
+	for _, name := range []string{"default", "api", "static", "admin"} {
+		backend := BackendPort{Name: name + "_1", URL: &url.URL{Scheme: "http", Host: "localhost:3000"}}
+		if name != DefaultPool {
+			backend.Pool = name
+		}
+		config.Backend = append(config.Backend, backend)
+	}
+
+	var ph proxyHandler
+	if err := ph.setPools(&config, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	table := ph.getRoutes()
+	for _, test := range []struct {
+		method   string
+		target   string
+		headers  map[string]string
+		expected string
+	}{
+		{http.MethodGet, "http://api.example.com/users", nil, "api"},
+		{http.MethodPost, "http://API.example.com.:8080/users", nil, "api"},
+		{http.MethodGet, "http://v2.api.example.com/users", nil, "api"},
+		{http.MethodDelete, "http://api.example.com/users", nil, DefaultPool},
+		{http.MethodGet, "http://www.example.com/static/site.css", nil, "static"},
+		{http.MethodGet, "http://www.example.com/static/logo.png", nil, DefaultPool},
+		{http.MethodGet, "http://admin.example.com/", map[string]string{"X-Admin-Token": "secret"}, "admin"},
+		{http.MethodGet, "http://admin.example.com/", map[string]string{"X-Admin-Token": "secrets"}, DefaultPool},
+		{http.MethodGet, "http://admin.example.com/", nil, DefaultPool},
+		{http.MethodGet, "http://www.example.com/internal/metrics", nil, "admin"},
+	} {
+		// httptest requests come from 192.0.2.1
+		request := httptest.NewRequest(test.method, test.target, nil)
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		if route := table.route(request); route.pool.name != test.expected {
+			t.Errorf("Expected %v %v to route to %v, got %v", test.method, test.target, test.expected, route.pool.name)
+		}
+	}
+
+	if pool := table.byBackend["api_1"]; pool != table.pools["api"] {
+		t.Error("Expected backends to be looked up in their pool")
+	}
+
+	// without backends in the default pool, unrouted requests have nowhere to go
+	config.Backend = config.Backend[1:]
+	if err := ph.setPools(&config, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if route := ph.getRoutes().route(httptest.NewRequest(http.MethodGet, "/", nil)); route != nil {
+		t.Errorf("Expected no pool for an unrouted request, got %v", route.pool.name)
+	}
+}
+
+func TestPoolHealth(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "pool_test"
+	config.Pools = []PoolConfig{{Name: "api"}}
+	config.Routes = []RouteConfig{{PathPrefix: "/api/", Pool: "api"}}
+	config.Backend = []BackendPort{
+		{Name: "server_1", URL: downstreamURL, Rise: 1, Fall: 1},
+		{Name: "api_1", Pool: "api", URL: downstreamURL, Rise: 1, Fall: 1},
+		{Name: "api_2", Pool: "api", URL: downstreamURL, Rise: 1, Fall: 1},
+	}
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+
+	serve := func(path string) int {
+		recorder := httptest.NewRecorder()
+		proxy.ph.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+
+	healthMonitor.observe(healthMonitor.checks["api_1"], false)
+	if code := serve("/api/users"); code != http.StatusOK {
+		t.Errorf("Expected the api pool to serve with one backend left, got %v", code)
+	}
+	healthMonitor.observe(healthMonitor.checks["api_2"], false)
+	if code := serve("/api/users"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the api pool to refuse requests without healthy backends, got %v", code)
+	}
+	if code := serve("/"); code != http.StatusOK {
+		t.Errorf("Expected the default pool to keep serving, got %v", code)
+	}
+	if healthMonitor.IsUnhealthy() {
+		t.Error("Expected an unhealthy named pool to leave the server up")
+	}
+
+	// pools that are down stay down across reloads
+	healthMonitor.Reload(&config)
+	if code := serve("/api/users"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the api pool to stay down after a reload, got %v", code)
+	}
+	healthMonitor.observe(healthMonitor.checks["api_2"], true)
+	if code := serve("/api/users"); code != http.StatusOK {
+		t.Errorf("Expected the api pool to recover, got %v", code)
+	}
+}
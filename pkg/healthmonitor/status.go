@@ -0,0 +1,185 @@
+package healthmonitor
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// processStart is when the process started, for its uptime
+var processStart = time.Now()
+
+// ServerStatus is the status document of a frontend. State is up, down once
+// the default pool is unhealthy, or draining
+type ServerStatus struct {
+	Name              string          `json:"name"`
+	State             string          `json:"state"`
+	Ready             bool            `json:"ready"`
+	NumUnhealthy      uint32          `json:"num_unhealthy"`
+	Threshold         uint32          `json:"threshold"`
+	Pools             []PoolStatus    `json:"pools"`
+	ActiveConnections uint32          `json:"active_connections"`
+	MaxConn           uint32          `json:"max_conn"`
+	QueueLength       int             `json:"queue_length"`
+	UptimeSeconds     float64         `json:"uptime_seconds"`
+	ConfigVersion     string          `json:"config_version"`
+	ConfigLoadedAt    time.Time       `json:"config_loaded_at"`
+	Backends          []BackendStatus `json:"backends"`
+}
+
+// PoolStatus is the health of a pool within a ServerStatus
+type PoolStatus struct {
+	Name         string `json:"name"`
+	Healthy      bool   `json:"healthy"`
+	NumUnhealthy uint32 `json:"num_unhealthy"`
+	Threshold    uint32 `json:"threshold"`
+}
+
+// Status returns the status document of the frontend
+func (hm *HealthMonitor) Status() ServerStatus {
+	ph := &hm.proxy.ph
+	status := ServerStatus{
+		Name:              hm.serverLabel["server"],
+		State:             "up",
+		Ready:             hm.IsReady(),
+		NumUnhealthy:      atomic.LoadUint32(&hm.numUnhealthy),
+		Threshold:         atomic.LoadUint32(&hm.threshold),
+		ActiveConnections: atomic.LoadUint32(&ph.curConn),
+		MaxConn:           atomic.LoadUint32(&ph.maxConn),
+		UptimeSeconds:     time.Since(hm.started).Seconds(),
+		Backends:          hm.Backends(),
+	}
+	if hm.IsUnhealthy() {
+		status.State = "down"
+	} else if ph.isDraining() {
+		status.State = "draining"
+	}
+	ph.queue.mu.Lock()
+	status.QueueLength = len(ph.queue.waiters)
+	ph.queue.mu.Unlock()
+
+	hm.mu.Lock()
+	status.ConfigVersion, status.ConfigLoadedAt = hm.configVersion, hm.configLoadedAt
+	status.Pools = append(status.Pools, poolStatus(DefaultPool, &hm.poolHealth))
+	for name, pool := range hm.pools {
+		status.Pools = append(status.Pools, poolStatus(name, pool))
+	}
+	hm.mu.Unlock()
+	sort.Slice(status.Pools, func(i, j int) bool { return status.Pools[i].Name < status.Pools[j].Name })
+	return status
+}
+
+func poolStatus(name string, pool *poolHealth) PoolStatus {
+	return PoolStatus{
+		Name:         name,
+		Healthy:      !pool.isUnhealthy(),
+		NumUnhealthy: atomic.LoadUint32(&pool.numUnhealthy),
+		Threshold:    atomic.LoadUint32(&pool.threshold),
+	}
+}
+
+// IsReady returns true while the frontend takes requests, that is while it is
+// healthy and neither draining nor shut down
+func (hm *HealthMonitor) IsReady() bool {
+	return !hm.IsUnhealthy() && !hm.proxy.ph.isDraining() && !hm.proxy.IsInShutdown()
+}
+
+// statusHandler answers /status on the port of a frontend, which load
+// balancers in front of the proxy check. It fails while the frontend is not
+// ready. Its body is only the status text, the status document is served on
+// the metrics server so that it is not exposed to clients
+type statusHandler struct {
+	proxy *ProxyServer
+}
+
+func (sh *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// haproxy docs say health checks consist of estabilishing tcp connection
+	// if server is in shutdown, this will fail, otherwise it will succeed
+	// this will only be needed if using httpchk
+	// http:// cbonte.github.io/haproxy-dconv/2.0/configuration.html
+	// in drain mode the listener stays up, so the status code has to fail
+	// instead
+	ready := !sh.proxy.ph.isDraining()
+	if hm := sh.proxy.monitor; hm != nil {
+		ready = hm.IsReady()
+	}
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, http.StatusText(code))
+}
+
+// processStatus is the status document of the metrics server. Alive is false
+// while any frontend is down
+type processStatus struct {
+	Alive         bool           `json:"alive"`
+	Ready         bool           `json:"ready"`
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Frontends     []ServerStatus `json:"frontends"`
+}
+
+// NewStatusMux returns the status endpoints of the metrics server for the
+// health monitors of the frontends by name:
+//
+//	/status  status document of the process and every frontend, 503 while
+//	         any frontend is down
+//	/livez   200 while no frontend is down, 503 otherwise
+//	/readyz  200 while every frontend is ready, 503 otherwise
+func NewStatusMux(monitors map[string]*HealthMonitor) *http.ServeMux {
+	alive := func() bool {
+		for _, hm := range monitors {
+			if hm.IsUnhealthy() {
+				return false
+			}
+		}
+		return true
+	}
+	ready := func() bool {
+		for _, hm := range monitors {
+			if !hm.IsReady() {
+				return false
+			}
+		}
+		return true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := processStatus{Alive: true, Ready: true, UptimeSeconds: time.Since(processStart).Seconds(), Frontends: []ServerStatus{}}
+		names := make([]string, 0, len(monitors))
+		for name := range monitors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			frontend := monitors[name].Status()
+			status.Alive = status.Alive && frontend.State != "down"
+			status.Ready = status.Ready && frontend.Ready
+			status.Frontends = append(status.Frontends, frontend)
+		}
+		code := http.StatusOK
+		if !status.Alive {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, status)
+	})
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusOK
+		if !alive() {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, map[string]bool{"alive": code == http.StatusOK})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusOK
+		if !ready() {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, map[string]bool{"ready": code == http.StatusOK})
+	})
+	return mux
+}
@@ -0,0 +1,117 @@
+package healthmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// switchChecker fails while healthy is 0
+type switchChecker struct {
+	healthy int32
+}
+
+func (checker *switchChecker) Check(ctx context.Context) error {
+	if atomic.LoadInt32(&checker.healthy) == 0 {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestStatusEndpoints(t *testing.T) {
+	checker := &switchChecker{healthy: 1}
+	var config Config
+	config.Proxy.Name = "status_test"
+	config.Proxy.MaxConn = 10
+	config.Proxy.MinAlive = 1
+	config.Version = "abc123"
+	for _, name := range []string{"status_1", "status_2"} {
+		backend := BackendPort{
+			Name:                name,
+			URL:                 &url.URL{Scheme: "http", Host: "localhost:3000"},
+			HealthCheckInterval: 10 * time.Millisecond,
+			Rise:                1,
+			Fall:                1,
+		}
+		if name == "status_1" {
+			backend.HealthCheck.Checker = checker
+		} else {
+			backend.HealthCheck.Checker = &switchChecker{healthy: 1}
+		}
+		config.Backend = append(config.Backend, backend)
+	}
+	proxy := NewProxyServer(&config)
+	healthMonitor := NewHealthMonitor(&config, proxy)
+	healthMonitor.Start(context.Background())
+	defer healthMonitor.Stop()
+	mux := NewStatusMux(map[string]*HealthMonitor{"status_test": healthMonitor})
+
+	get := func(handler http.Handler, path string, document interface{}) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if document != nil {
+			if err := json.NewDecoder(recorder.Body).Decode(document); err != nil {
+				t.Fatalf("Expected json from %v: %v", path, err)
+			}
+		}
+		return recorder.Code
+	}
+	waitFor := func(condition func(ServerStatus) bool) ServerStatus {
+		var status ServerStatus
+		for i := 0; i < 100; i++ {
+			if status = healthMonitor.Status(); condition(status) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return status
+	}
+
+	status := waitFor(func(status ServerStatus) bool {
+		return status.Backends[0].LastCheck != nil && status.Backends[1].LastCheck != nil
+	})
+	if status.State != "up" || !status.Ready || status.ConfigVersion != "abc123" || status.Threshold != 1 {
+		t.Errorf("Expected the server to be up, got %+v", status)
+	}
+	if code := get(mux, "/readyz", nil); code != http.StatusOK {
+		t.Errorf("Expected /readyz to succeed, got %v", code)
+	}
+	recorder := httptest.NewRecorder()
+	(&statusHandler{proxy: proxy}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "OK\n" {
+		t.Errorf("Expected /status of the frontend to only succeed, got %v %q", recorder.Code, recorder.Body)
+	}
+	if code := get(mux, "/livez", nil); code != http.StatusOK {
+		t.Errorf("Expected /livez to succeed, got %v", code)
+	}
+
+	atomic.StoreInt32(&checker.healthy, 0)
+	status = waitFor(func(status ServerStatus) bool { return status.State == "down" })
+	if status.Ready || status.NumUnhealthy != 1 {
+		t.Errorf("Expected the server to be down, got %+v", status)
+	}
+	backend := status.Backends[0]
+	if backend.State != "unhealthy" || backend.LastError != "connection refused" || backend.ConsecutiveFailures == 0 {
+		t.Errorf("Expected the failed check to be reported, got %+v", backend)
+	}
+
+	var document processStatus
+	if code := get(mux, "/status", &document); code != http.StatusServiceUnavailable || document.Alive || document.Ready || len(document.Frontends) != 1 {
+		t.Errorf("Expected the process status to report the frontend down, got %v %+v", code, document)
+	}
+	if code := get(mux, "/livez", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /livez to fail while a frontend is down, got %v", code)
+	}
+	if code := get(mux, "/readyz", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail while a frontend is down, got %v", code)
+	}
+	if code := get(&statusHandler{proxy: proxy}, "/status", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /status of the frontend to fail, got %v", code)
+	}
+}
@@ -0,0 +1,267 @@
+package healthmonitor
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wish/tcp-mux-proxy/pkg/loadbalancer"
+)
+
+const tcpDialTimeout = 5 * time.Second
+
+// tcpServer accepts raw tcp connections and splices them to a backend chosen
+// by the load balancer. It mirrors the parts of http.Server used by ProxyServer
+type tcpServer struct {
+	addr string
+	ph   *proxyHandler
+	// tlsConfig terminates tls on accepted connections if set
+	tlsConfig *tls.Config
+
+	// mu guards listener, closed and active, and orders conns.Add before
+	// the conns.Wait of Shutdown
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	active   map[net.Conn]struct{}
+	conns    sync.WaitGroup
+}
+
+// ListenAndServe accepts connections until Shutdown is called, after which it
+// returns http.ErrServerClosed like http.Server does
+func (s *tcpServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	// the PROXY protocol header comes ahead of the tls handshake
+	listener = &proxyProtocolListener{Listener: listener, ph: s.ph}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return http.ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return http.ErrServerClosed
+		}
+		if s.active == nil {
+			s.active = make(map[net.Conn]struct{})
+		}
+		s.active[conn] = struct{}{}
+		s.conns.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.conns.Done()
+			defer s.untrack(conn)
+			s.ph.serveTCP(conn)
+		}()
+	}
+}
+
+func (s *tcpServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.active, conn)
+	s.mu.Unlock()
+}
+
+// Shutdown closes the listener and waits for the active connections to finish.
+// Once ctx is done the connections still active are closed, which ends their
+// splice, and Shutdown returns the error of ctx
+func (s *tcpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for conn := range s.active {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+func (ph *proxyHandler) serveTCP(conn net.Conn) {
+	defer conn.Close()
+	serverLabel := prometheus.Labels{"server": ph.name, "result": "draining"}
+	if ph.isDraining() {
+		// a raw tcp proxy has no way to say why, so just hang up
+		ph.metrics.tcpConnections.With(serverLabel).Inc()
+		return
+	}
+	serverLabel["result"] = "refused"
+	if !ph.admit() {
+		ph.metrics.tcpConnections.With(serverLabel).Inc()
+		return
+	}
+	defer ph.release()
+
+	pool := ph.getPool()
+	if len(pool.backends) == 0 {
+		ph.metrics.tcpConnections.With(serverLabel).Inc()
+		return
+	}
+	ctx := loadbalancer.WithHashKey(context.Background(), clientIP(conn.RemoteAddr().String()))
+	id := pool.lb.GetDownstream(ctx)
+	pool.lb.IncConn(id)
+	defer pool.lb.DecConn(id)
+
+	backend := pool.backends[id]
+	backendLabel := prometheus.Labels{"server": ph.name, "backend": backend.Name}
+	ph.metrics.numActiveConnections.With(backendLabel).Inc()
+	defer ph.metrics.numActiveConnections.With(backendLabel).Dec()
+	defer ph.trackConnection(backend.Name)()
+
+	tStart := time.Now()
+	upstream, err := dialBackend(backend, pool.tlsConfigs[id], conn)
+	if observer, ok := pool.lb.(loadbalancer.LatencyObserver); ok && err == nil {
+		// the connect time is the only latency a raw tcp proxy can observe
+		observer.ObserveLatency(id, time.Since(tStart))
+	}
+	if ph.outliers != nil {
+		ph.outliers.record(backend.Name, err == nil)
+	}
+	if err != nil {
+		log.Printf("Could not connect to backend %v: %v\n", backend.Name, err)
+		serverLabel["result"] = "dial_error"
+		ph.metrics.tcpConnections.With(serverLabel).Inc()
+		return
+	}
+	defer upstream.Close()
+
+	serverLabel["result"] = "proxied"
+	ph.metrics.tcpConnections.With(serverLabel).Inc()
+	if ph.shutdownMode == ShutdownModeDrain {
+		ctx, cancel := ph.withDrainDeadline(context.Background())
+		defer cancel()
+		go func() {
+			<-ctx.Done()
+			// unblocks splice if the drain timeout expires first
+			conn.Close()
+			upstream.Close()
+		}()
+	}
+	sent, received := splice(conn, upstream)
+	bytesLabel := prometheus.Labels{"server": ph.name, "backend": backend.Name}
+	ph.metrics.backendSentBytes.With(bytesLabel).Add(float64(sent))
+	ph.metrics.backendReceivedBytes.With(bytesLabel).Add(float64(received))
+}
+
+// dialBackend connects to a backend on behalf of client, sending the PROXY
+// protocol header if the backend wants one. The timeout includes the header
+// and the tls handshake
+func dialBackend(backend BackendPort, tlsConfig *tls.Config, client net.Conn) (net.Conn, error) {
+	timeout := backend.Transport.DialTimeout
+	if timeout <= 0 {
+		timeout = tcpDialTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	dialer := &net.Dialer{
+		Deadline:  deadline,
+		KeepAlive: backend.Transport.KeepAlive,
+	}
+	conn, err := dialer.Dial("tcp", backend.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(deadline)
+	if backend.ProxyProtocol != "" {
+		if err := writeProxyHeader(conn, backend.ProxyProtocol, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify {
+			// like tls.Dial, verify the backend against the name it was dialed by
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(backend.Address)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// splice copies bytes in both directions until both sides are done, half
+// closing each side as its peer finishes writing. It returns the number of
+// bytes sent to upstream and received from it
+func splice(client, upstream net.Conn) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(upstream, client)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+	return sent, received
+}
+
+// closeWrite half closes tcp and tls connections, anything else is closed
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
+		return
+	}
+	conn.Close()
+}
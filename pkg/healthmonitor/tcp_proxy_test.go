@@ -0,0 +1,171 @@
+package healthmonitor
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func runEchoDownstream(t *testing.T) (net.Listener, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					conn.Write([]byte(scanner.Text() + "\n"))
+				}
+			}()
+		}
+	}()
+	return listener, listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestTCPProxyServer(t *testing.T) {
+	var config Config
+	config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	config.Proxy.Mode = ModeTCP
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "tcp_test"
+	for i := 0; i < 2; i++ {
+		listener, port := runEchoDownstream(t)
+		defer listener.Close()
+		config.Backend = append(config.Backend, BackendPort{
+			Name:    "echo_" + strconv.Itoa(i),
+			Port:    port,
+			Address: "127.0.0.1:" + strconv.Itoa(port),
+		})
+	}
+
+	proxy := NewProxyServer(&config)
+	go proxy.Start()
+	defer proxy.stop()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", config.Proxy.Bind); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for _, msg := range []string{"PING", "hello world"} {
+		conn.Write([]byte(msg + "\n"))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != msg+"\n" {
+			t.Errorf("Expected %q, got %q", msg+"\n", line)
+		}
+	}
+
+	if atomic.LoadUint32(&proxy.ph.curConn) != 1 {
+		t.Errorf("Expected 1 active connection, got %v", proxy.ph.curConn)
+	}
+}
+
+func TestTCPProxyShutdown(t *testing.T) {
+	var config Config
+	config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	config.Proxy.Mode = ModeTCP
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "tcp_shutdown_test"
+	config.Proxy.Drain.Timeout = 50 * time.Millisecond
+	listener, port := runEchoDownstream(t)
+	defer listener.Close()
+	config.Backend = []BackendPort{{Name: "echo", Port: port, Address: "127.0.0.1:" + strconv.Itoa(port)}}
+
+	proxy := NewProxyServer(&config)
+	go proxy.Start()
+	defer proxy.stop()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", config.Proxy.Bind); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("PING\n"))
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	// the idle connection is closed once the drain timeout expires
+	done := make(chan struct{})
+	go func() {
+		proxy.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected shutdown to close the connection still open")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestTCPProxyWithoutBackends(t *testing.T) {
+	var config Config
+	config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	config.Proxy.Mode = ModeTCP
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "tcp_empty_test"
+
+	proxy := NewProxyServer(&config)
+	go proxy.Start()
+	defer proxy.stop()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", config.Proxy.Bind); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the connection to be refused without backends")
+	}
+}
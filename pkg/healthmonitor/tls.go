@@ -0,0 +1,312 @@
+package healthmonitor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTLSReloadInterval = 10 * time.Second
+
+// TLSConfig configures TLS termination on the proxy listener. The
+// certificate is picked by SNI from the names it is valid for, the first
+// one is used when nothing matches. Certificates and the client CA are
+// reloaded from disk when they change
+type TLSConfig struct {
+	Certificates []CertificateConfig `yaml:"certificates"`
+	// MinVersion is one of 1.0, 1.1, 1.2 and 1.3, it defaults to 1.2
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites are the crypto/tls names of the TLS 1.2 cipher suites
+	// to allow, TLS 1.3 suites are not configurable
+	CipherSuites []string `yaml:"cipher_suites"`
+	// ClientAuth is one of none, request, require_any, verify_if_given and
+	// require_and_verify. Verification uses the certificates in ClientCA
+	ClientAuth     string        `yaml:"client_auth"`
+	ClientCA       string        `yaml:"client_ca"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// CertificateConfig is a PEM encoded certificate chain and its key
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func (config TLSConfig) enabled() bool {
+	return len(config.Certificates) > 0
+}
+
+func (config *TLSConfig) setDefaults() {
+	if config.MinVersion == "" {
+		config.MinVersion = "1.2"
+	}
+	if config.ClientAuth == "" {
+		config.ClientAuth = "none"
+	}
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = defaultTLSReloadInterval
+	}
+}
+
+// files returns every file the config is loaded from
+func (config TLSConfig) files() []string {
+	var files []string
+	for _, cert := range config.Certificates {
+		files = append(files, cert.CertFile, cert.KeyFile)
+	}
+	if config.ClientCA != "" {
+		files = append(files, config.ClientCA)
+	}
+	return files
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":        tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":          tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require_any":        tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// buildTLSConfig loads the files of config and builds the tls.Config used
+// for the connections accepted until the next reload
+func buildTLSConfig(config TLSConfig) (*tls.Config, error) {
+	config.setDefaults()
+	tlsConfig := &tls.Config{}
+
+	version, ok := tlsVersions[config.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("Unknown TLS version: %q", config.MinVersion)
+	}
+	tlsConfig.MinVersion = version
+
+	for _, name := range config.CipherSuites {
+		suite, ok := tlsCipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown cipher suite: %q", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite)
+	}
+
+	clientAuth, ok := tlsClientAuth[config.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("Unknown client_auth: %q", config.ClientAuth)
+	}
+	tlsConfig.ClientAuth = clientAuth
+	if config.ClientCA != "" {
+		pool, err := loadCertPool(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth %v needs a client_ca", config.ClientAuth)
+	}
+
+	for _, certConfig := range config.Certificates {
+		cert, err := tls.LoadX509KeyPair(certConfig.CertFile, certConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load certificate %v: %v", certConfig.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse certificate %v: %v", certConfig.CertFile, err)
+		}
+		cert.Leaf = leaf
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	if len(tlsConfig.Certificates) == 0 {
+		return nil, fmt.Errorf("No certificates configured")
+	}
+
+	names := make(map[string]*tls.Certificate)
+	for i := range tlsConfig.Certificates {
+		leaf := tlsConfig.Certificates[i].Leaf
+		certNames := leaf.DNSNames
+		if len(certNames) == 0 && leaf.Subject.CommonName != "" {
+			certNames = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range certNames {
+			// the first certificate for a name wins
+			if _, ok := names[strings.ToLower(name)]; !ok {
+				names[strings.ToLower(name)] = &tlsConfig.Certificates[i]
+			}
+		}
+	}
+
+	defaultCert := &tlsConfig.Certificates[0]
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if cert, ok := names[name]; ok {
+			return cert, nil
+		}
+		if i := strings.Index(name, "."); i > 0 {
+			if cert, ok := names["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+		return defaultCert, nil
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %v", file)
+	}
+	return pool, nil
+}
+
+// certWatcher hands out the current tls.Config to new connections, and
+// rebuilds it when its config or the files it was loaded from change
+type certWatcher struct {
+	current atomic.Value // *tls.Config
+
+	// mu guards config and modTimes
+	mu       sync.Mutex
+	config   TLSConfig
+	modTimes map[string]time.Time
+}
+
+func newCertWatcher(config TLSConfig) *certWatcher {
+	watcher := &certWatcher{}
+	watcher.setConfig(config)
+	return watcher
+}
+
+// setConfig switches to a new config, the current one is kept if the new
+// one cannot be loaded
+func (watcher *certWatcher) setConfig(config TLSConfig) {
+	config.setDefaults()
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	watcher.config = config
+	watcher.load()
+}
+
+// reload rebuilds the tls.Config if any of its files changed since the last load
+func (watcher *certWatcher) reload() {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	for _, file := range watcher.config.files() {
+		if !fileModTime(file).Equal(watcher.modTimes[file]) {
+			watcher.load()
+			return
+		}
+	}
+}
+
+// load must be called with mu held
+func (watcher *certWatcher) load() {
+	// take the times first so changes made while loading are picked up next time
+	modTimes := make(map[string]time.Time)
+	for _, file := range watcher.config.files() {
+		modTimes[file] = fileModTime(file)
+	}
+	watcher.modTimes = modTimes
+
+	tlsConfig, err := buildTLSConfig(watcher.config)
+	if err != nil {
+		log.Printf("Could not load TLS config, keeping the previous one: %v\n", err)
+		return
+	}
+	watcher.current.Store(tlsConfig)
+	log.Println("Loaded TLS certificates")
+}
+
+// run checks the files for changes every reload interval until done is closed
+func (watcher *certWatcher) run(done <-chan struct{}) {
+	for {
+		watcher.mu.Lock()
+		interval := watcher.config.ReloadInterval
+		watcher.mu.Unlock()
+
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		watcher.reload()
+	}
+}
+
+// tlsConfig returns the config to serve with, which defers every handshake to
+// the tls.Config current at the time. nextProtos are the protocols offered
+// over alpn
+func (watcher *certWatcher) tlsConfig(nextProtos []string) *tls.Config {
+	base := &tls.Config{NextProtos: nextProtos}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		current, err := watcher.getCurrent()
+		if err != nil || len(base.NextProtos) == 0 {
+			return current, err
+		}
+		// the returned config replaces base for the handshake, so it has to
+		// offer the same protocols
+		current = current.Clone()
+		current.NextProtos = base.NextProtos
+		return current, nil
+	}
+	// only consulted by http.Server to check a certificate is configured
+	base.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		tlsConfig, err := watcher.getCurrent()
+		if err != nil {
+			return nil, err
+		}
+		return tlsConfig.GetCertificate(hello)
+	}
+	return base
+}
+
+func (watcher *certWatcher) getCurrent() (*tls.Config, error) {
+	tlsConfig, ok := watcher.current.Load().(*tls.Config)
+	if !ok {
+		return nil, fmt.Errorf("No TLS certificates loaded")
+	}
+	return tlsConfig, nil
+}
+
+func fileModTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
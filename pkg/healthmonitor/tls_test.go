@@ -0,0 +1,252 @@
+package healthmonitor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeCert writes a self signed certificate for names and its key to dir
+func writeCert(t *testing.T, dir, name string, serial int64, names ...string) CertificateConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := CertificateConfig{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(config.CertFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.KeyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestCertWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := TLSConfig{Certificates: []CertificateConfig{
+		writeCert(t, dir, "a", 1, "a.example.com"),
+		writeCert(t, dir, "b", 2, "*.b.example.com"),
+	}}
+	watcher := newCertWatcher(config)
+
+	serial := func(serverName string) int64 {
+		hello := &tls.ClientHelloInfo{ServerName: serverName}
+		tlsConfig, err := watcher.tlsConfig(nil).GetConfigForClient(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tlsConfig.GetCertificate(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.SerialNumber.Int64()
+	}
+
+	for serverName, expected := range map[string]int64{
+		"a.example.com":   1,
+		"A.example.com.":  1,
+		"x.b.example.com": 2,
+		"b.example.com":   1,
+		"":                1,
+	} {
+		if actual := serial(serverName); actual != expected {
+			t.Errorf("Expected certificate %v for %q, got %v", expected, serverName, actual)
+		}
+	}
+
+	writeCert(t, dir, "a", 3, "a.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(config.Certificates[0].CertFile, later, later)
+	watcher.reload()
+	if actual := serial("a.example.com"); actual != 3 {
+		t.Errorf("Expected the reloaded certificate, got %v", actual)
+	}
+
+	ioutil.WriteFile(config.Certificates[0].CertFile, []byte("garbage"), 0600)
+	os.Chtimes(config.Certificates[0].CertFile, later.Add(time.Minute), later.Add(time.Minute))
+	watcher.reload()
+	if actual := serial("a.example.com"); actual != 3 {
+		t.Errorf("Expected a broken certificate to keep the previous one, got %v", actual)
+	}
+}
+
+func TestTLSProxyServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.Bind = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "tls_test"
+	config.Proxy.TLS.Certificates = []CertificateConfig{writeCert(t, dir, "proxy", 1, "proxy.example.com")}
+	config.Backend = []BackendPort{{Name: "server_1", URL: downstreamURL}}
+
+	proxy := NewProxyServer(&config)
+	go proxy.Start()
+	defer proxy.shutdown()
+
+	roots, err := loadCertPool(config.Proxy.TLS.Certificates[0].CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "proxy.example.com"},
+	}}
+
+	var response *http.Response
+	for i := 0; i < 50; i++ {
+		if response, err = client.Get("https://" + config.Proxy.Bind + "/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %v", response.StatusCode)
+	}
+
+	// the certificates are picked per connection, which must not lose alpn
+	conn, err := tls.Dial("tcp", config.Proxy.Bind, &tls.Config{RootCAs: roots, ServerName: "proxy.example.com", NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+		t.Errorf("Expected h2 to be negotiated, got %q", protocol)
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCert := writeCert(t, dir, "server", 1, "backend.internal")
+	clientCert := writeCert(t, dir, "client", 2, "proxy.internal")
+	clientCAs, err := loadCertPool(clientCert.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(serverCert.CertFile, serverCert.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	downstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	downstream.StartTLS()
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	backend := BackendPort{
+		Name:    "server_1",
+		URL:     downstreamURL,
+		Address: downstreamURL.Host,
+		TLS: BackendTLSConfig{
+			Enabled:    true,
+			CAFile:     serverCert.CertFile,
+			CertFile:   clientCert.CertFile,
+			KeyFile:    clientCert.KeyFile,
+			ServerName: "backend.internal",
+		},
+	}
+	for _, checkType := range []string{HealthCheckHTTP, HealthCheckTCP} {
+		backend.HealthCheck.Type = checkType
+		if err := runHealthCheck(t, backend); err != nil {
+			t.Errorf("Expected the %v check to be healthy, got %v", checkType, err)
+		}
+	}
+
+	withoutClientCert := backend
+	withoutClientCert.TLS.CertFile, withoutClientCert.TLS.KeyFile = "", ""
+	withoutClientCert.HealthCheck.Type = HealthCheckHTTP
+	if err := runHealthCheck(t, withoutClientCert); err == nil {
+		t.Error("Expected the check to fail without a client certificate")
+	}
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "backend_tls_test"
+	config.Backend = []BackendPort{backend}
+	proxy := NewProxyServer(&config)
+	recorder := httptest.NewRecorder()
+	proxy.ph.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200 through the proxy, got %v", recorder.Code)
+	}
+
+	// a reload whose client certificate went missing keeps the previous pool
+	pool := proxy.ph.getPool()
+	missing := config
+	missing.Backend = []BackendPort{backend}
+	missing.Backend[0].TLS.CertFile = filepath.Join(dir, "missing.crt")
+	proxy.reload(&missing, nil, nil)
+	if proxy.ph.getPool() != pool {
+		t.Error("Expected the previous pool to be kept")
+	}
+	if _, err := New(&missing, WithMetricsBind(""), WithRegisterer(prometheus.NewRegistry())); err == nil {
+		t.Error("Expected a proxy with a missing client certificate to be refused")
+	}
+}
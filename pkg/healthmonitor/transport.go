@@ -0,0 +1,124 @@
+package healthmonitor
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Transport defaults, the same as http.DefaultTransport uses
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 100
+)
+
+// TransportConfig tunes the connection pool to a backend. It can be set for
+// the proxy and per backend, where every field left at zero is taken from
+// the proxy. MaxConns limits the connections to a backend including those in
+// use, zero means no limit. MaxIdleConnsPerHost defaults to MaxIdleConns, as
+// a transport only talks to one backend unless an http proxy is in the way.
+// ResponseHeaderTimeout defaults to no timeout, the other fields default to
+// what http.DefaultTransport uses
+type TransportConfig struct {
+	MaxIdleConns          int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host"`
+	MaxConns              int           `yaml:"max_conns"`
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	KeepAlive             time.Duration `yaml:"keep_alive"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`
+}
+
+// inherit fills the fields left at zero from defaults
+func (config TransportConfig) inherit(defaults TransportConfig) TransportConfig {
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = defaults.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaults.MaxIdleConnsPerHost
+	}
+	if config.MaxConns == 0 {
+		config.MaxConns = defaults.MaxConns
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaults.DialTimeout
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = defaults.KeepAlive
+	}
+	if config.TLSHandshakeTimeout == 0 {
+		config.TLSHandshakeTimeout = defaults.TLSHandshakeTimeout
+	}
+	if config.ResponseHeaderTimeout == 0 {
+		config.ResponseHeaderTimeout = defaults.ResponseHeaderTimeout
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = defaults.IdleConnTimeout
+	}
+	return config
+}
+
+// newBackendTransport makes the transport proxied requests to a backend are
+// sent with, its dials and open connections are counted in the metrics
+func (ph *proxyHandler) newBackendTransport(backend BackendPort, tlsConfig *tls.Config) *http.Transport {
+	config := backend.Transport.inherit(TransportConfig{
+		MaxIdleConns:        defaultMaxIdleConns,
+		DialTimeout:         defaultDialTimeout,
+		KeepAlive:           defaultKeepAlive,
+		TLSHandshakeTimeout: defaultTLSHandshakeTimeout,
+		IdleConnTimeout:     defaultIdleConnTimeout,
+	})
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = config.MaxIdleConns
+	}
+	backendLabel := prometheus.Labels{"server": ph.name, "backend": backend.Name}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			ph.metrics.backendDials.With(prometheus.Labels{"server": ph.name, "backend": backend.Name, "success": strconv.FormatBool(err == nil)}).Inc()
+			if err != nil {
+				return nil, err
+			}
+			ph.metrics.backendOpenConnections.With(backendLabel).Inc()
+			return &trackedConn{Conn: conn, onClose: func() {
+				ph.metrics.backendOpenConnections.With(backendLabel).Dec()
+			}}, nil
+		},
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConns,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+// trackedConn calls onClose the first time it is closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (conn *trackedConn) Close() error {
+	conn.once.Do(conn.onClose)
+	return conn.Conn.Close()
+}
@@ -0,0 +1,82 @@
+package healthmonitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTransportConfigInherit(t *testing.T) {
+	defaults := TransportConfig{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, DialTimeout: time.Second, ResponseHeaderTimeout: time.Minute}
+	config := TransportConfig{MaxIdleConns: 2, KeepAlive: time.Hour}.inherit(defaults)
+	expected := TransportConfig{MaxIdleConns: 2, MaxIdleConnsPerHost: 5, DialTimeout: time.Second, KeepAlive: time.Hour, ResponseHeaderTimeout: time.Minute}
+	if config != expected {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+
+	var ph proxyHandler
+	transport := ph.newBackendTransport(BackendPort{Transport: TransportConfig{MaxIdleConns: 20}}, nil)
+	if transport.MaxIdleConns != 20 || transport.MaxIdleConnsPerHost != 20 {
+		t.Errorf("Expected the idle connections per host to default to max_idle_conns, got %v", transport.MaxIdleConnsPerHost)
+	}
+	transport = ph.newBackendTransport(BackendPort{Transport: TransportConfig{MaxIdleConns: 20, MaxIdleConnsPerHost: 4}}, nil)
+	if transport.MaxIdleConns != 20 || transport.MaxIdleConnsPerHost != 4 {
+		t.Errorf("Expected 4 idle connections per host, got %v", transport.MaxIdleConnsPerHost)
+	}
+}
+
+func TestBackendTransport(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer downstream.Close()
+	downstreamURL, _ := url.Parse(downstream.URL)
+
+	var config Config
+	config.Proxy.MaxConn = 10
+	config.Proxy.Name = "transport_test"
+	config.Backend = []BackendPort{{
+		Name:      "server_1",
+		URL:       downstreamURL,
+		Transport: TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond},
+	}}
+	registry := prometheus.NewRegistry()
+	proxy, err := New(&config, WithMetricsBind(""), WithRegisterer(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &proxy.frontends[0].proxy.ph
+
+	serve := func(path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+	if code := serve("/slow"); code != http.StatusBadGateway {
+		t.Errorf("Expected the response header timeout to give status 502, got %v", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := serve("/"); code != http.StatusOK {
+			t.Errorf("Expected status 200, got %v", code)
+		}
+	}
+
+	backendLabels := map[string]string{"server": "transport_test", "backend": "server_1"}
+	reusedLabels := map[string]string{"server": "transport_test", "backend": "server_1", "reused": "true"}
+	if reused := gatherMetric(t, registry, "tcp_mux_proxy_backend_connections_acquired_total", reusedLabels).GetCounter().GetValue(); reused != 2 {
+		t.Errorf("Expected 2 reused connections, got %v", reused)
+	}
+	if open := gatherMetric(t, registry, "tcp_mux_proxy_backend_open_connections", backendLabels).GetGauge().GetValue(); open != 1 {
+		t.Errorf("Expected 1 open connection, got %v", open)
+	}
+	handler.getPool().closeIdleConnections()
+	if open := gatherMetric(t, registry, "tcp_mux_proxy_backend_open_connections", backendLabels).GetGauge().GetValue(); open != 0 {
+		t.Errorf("Expected no open connections after closing the idle ones, got %v", open)
+	}
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// downstreams tracks the connection counts and health of each downstream,
+// it is embedded by the load balancer implementations
+type downstreams struct {
+	// number of ports
+	n uint16
+	// connections are pointers so a reloaded balancer can share the counts
+	// of the requests still in flight on the balancer it replaces
+	connections []*uint32
+	idUnhealthy []uint32
+}
+
+func newDownstreams(n uint16) downstreams {
+	d := downstreams{
+		n:           n,
+		connections: make([]*uint32, n),
+		idUnhealthy: make([]uint32, n),
+	}
+	for i := range d.connections {
+		d.connections[i] = new(uint32)
+	}
+	return d
+}
+
+// carrier is implemented by every load balancer through downstreams, the
+// balancers with more state of their own override carry
+type carrier interface {
+	base() *downstreams
+	carry(previous LoadBalancer, id, previousID uint16)
+}
+
+func (d *downstreams) base() *downstreams {
+	return d
+}
+
+// carry makes downstream id share the connection count of previousID in
+// previous
+func (d *downstreams) carry(previous LoadBalancer, id, previousID uint16) {
+	prev, ok := previous.(carrier)
+	if !ok || id >= d.n || previousID >= prev.base().n {
+		return
+	}
+	d.connections[id] = prev.base().connections[previousID]
+}
+
+// MarkHealthy allows health monitor to tell LB when a downstream id becomes healthy
+func (d *downstreams) MarkHealthy(id uint16) {
+	atomic.StoreUint32(&d.idUnhealthy[id], 0)
+}
+
+// MarkUnhealthy allows health monitor to tell LB when a downstream id becomes unhealthy
+func (d *downstreams) MarkUnhealthy(id uint16) {
+	atomic.StoreUint32(&d.idUnhealthy[id], 1)
+}
+
+// DecConn decrements the number of connections of a particular downstream
+func (d *downstreams) DecConn(id uint16) error {
+	if id < 0 || id >= d.n {
+		return errors.New("Invalid id")
+	}
+	if atomic.LoadUint32(d.connections[id]) <= 0 {
+		return errors.New("Count cannot be less than zero")
+	}
+	// this will decrement the value: https:// golang.org/pkg/sync/atomic/#AddUint32
+	atomic.AddUint32(d.connections[id], ^uint32(0))
+	return nil
+}
+
+// IncConn increments the number of connections of a particular downstream
+func (d *downstreams) IncConn(id uint16) error {
+	if id < 0 || id >= d.n {
+		return errors.New("Invalid id")
+	}
+
+	atomic.AddUint32(d.connections[id], uint32(1))
+	return nil
+}
+
+func (d *downstreams) isHealthy(id uint16) bool {
+	return atomic.LoadUint32(&d.idUnhealthy[id]) == 0
+}
+
+func (d *downstreams) numConnections(id uint16) uint32 {
+	return atomic.LoadUint32(d.connections[id])
+}
+
+// this should only be used for testing
+func (d *downstreams) getConnections() []uint32 {
+	connectionsCopy := make([]uint32, len(d.connections))
+	for i := range d.connections {
+		connectionsCopy[i] = atomic.LoadUint32(d.connections[i])
+	}
+	return connectionsCopy
+}
@@ -0,0 +1,53 @@
+package loadbalancer
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+)
+
+type hashKeyContextKey struct{}
+
+// WithHashKey returns a copy of ctx carrying the key the hashing load
+// balancers route on. Requests with the same key go to the same downstream
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey{}, key)
+}
+
+// HashKey returns the hash key carried by ctx, or false if there is none
+func HashKey(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	key, ok := ctx.Value(hashKeyContextKey{}).(string)
+	return key, ok && key != ""
+}
+
+// hash64 is FNV-1a followed by the splitmix64 finalizer, which spreads
+// similar keys such as "server_1-0" and "server_1-1" across the whole range
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// randomHealthy is used by the hashing load balancers for requests without a key
+func (d *downstreams) randomHealthy() uint16 {
+	if d.n == 0 {
+		return 0
+	}
+	var id uint16
+	for i := 0; i < 5; i++ {
+		id = uint16(rand.Intn(int(d.n)))
+		if d.isHealthy(id) {
+			break
+		}
+	}
+	return id
+}
@@ -1,9 +1,12 @@
 package loadbalancer
 
 import (
+	"container/heap"
+	"context"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -11,29 +14,215 @@ import (
 
 func TestPowOfTwoLB(t *testing.T) {
 	n := uint16(30)
-	lb := NewPowerOfTwoLoadBalancer(n)
+	runDistribution("Power of Two", NewPowerOfTwoLoadBalancer(n), n, 3000000)
+}
+
+func TestRoundRobinLB(t *testing.T) {
+	n := uint16(30)
+	record := runDistribution("Round Robin", NewRoundRobinLoadBalancer(n), n, 100000)
+	if record[n-1]-record[0] > 1 {
+		t.Errorf("Round robin should be perfectly even, got min %v max %v", record[0], record[n-1])
+	}
+}
+
+func TestLeastConnLB(t *testing.T) {
+	n := uint16(30)
+	record := runDistribution("Least Connections", NewLeastConnLoadBalancer(n), n, 100000)
+	checkSpread(t, "Least connections", record, 0.1)
+}
+
+func TestRandomLB(t *testing.T) {
+	n := uint16(30)
+	record := runDistribution("Random", NewRandomLoadBalancer(n), n, 100000)
+	checkSpread(t, "Random", record, 0.15)
+}
+
+func TestPeakEWMALB(t *testing.T) {
+	n := uint16(30)
+	record := runDistribution("Peak EWMA", NewPeakEWMALoadBalancer(n), n, 300000)
+	checkSpread(t, "Peak EWMA", record, 0.15)
+
+	// a downstream 10 times slower than the others gets a fraction of its
+	// fair share
+	n = 10
+	lb := NewPeakEWMALoadBalancer(n)
+	counts := make([]int, n)
+	for i := 0; i < 100000; i++ {
+		id := lb.GetDownstream(context.Background())
+		counts[id]++
+		latency := time.Millisecond
+		if id == 0 {
+			latency = 10 * time.Millisecond
+		}
+		lb.ObserveLatency(id, latency)
+	}
+	if fair := 100000 / int(n); counts[0] > fair/2 {
+		t.Errorf("Peak EWMA should avoid the slow downstream, it got %v of a fair share of %v", counts[0], fair)
+	}
+}
+
+// checkSpread fails if the sorted request counts in record differ by more
+// than tolerance times their mean
+func checkSpread(t *testing.T, name string, record []int, tolerance float64) {
+	sum := 0
+	for _, count := range record {
+		sum += count
+	}
+	mean := float64(sum) / float64(len(record))
+	if spread := record[len(record)-1] - record[0]; float64(spread) > tolerance*mean {
+		t.Errorf("%v should spread requests evenly, got min %v max %v", name, record[0], record[len(record)-1])
+	}
+}
+
+// release is a connection to give back to the load balancer at a time
+type release struct {
+	at   time.Time
+	wait time.Duration
+	id   uint16
+}
+
+// releaseHeap orders releases by time
+type releaseHeap []release
+
+func (h releaseHeap) Len() int            { return len(h) }
+func (h releaseHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h releaseHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *releaseHeap) Push(x interface{}) { *h = append(*h, x.(release)) }
+func (h *releaseHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// runDistribution sends requests through lb that each hold a connection for
+// about a second, prints the spread of requests across the downstreams and
+// returns the sorted request counts once every connection is released. The
+// connections are released by a single goroutine rather than one per
+// request, which keeps large runs cheap under the race detector
+func runDistribution(name string, lb LoadBalancer, n uint16, requests int) []int {
 	record := make([]int, n)
+	observer, _ := lb.(LatencyObserver)
+	releases := make(chan release, 1024)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		in := releases
+		var pending releaseHeap
+		timer := time.NewTimer(time.Hour)
+		defer timer.Stop()
+		for in != nil || pending.Len() > 0 {
+			if pending.Len() > 0 {
+				timer.Reset(time.Until(pending[0].at))
+			}
+			select {
+			case r, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				heap.Push(&pending, r)
+			case <-timer.C:
+				for pending.Len() > 0 && !pending[0].at.After(time.Now()) {
+					r := heap.Pop(&pending).(release)
+					if observer != nil {
+						observer.ObserveLatency(r.id, r.wait)
+					}
+					lb.DecConn(r.id)
+				}
+			}
+		}
+	}()
 
-	for i := 0; i < 3000000; i++ {
-		id := lb.GetDownstream()
+	for i := 0; i < requests; i++ {
+		id := lb.GetDownstream(context.Background())
 		record[id]++
 		lb.IncConn(id)
 
-		go func(id uint16, lb *PowerOfTwoLoadBalancer) {
-			wait := time.Duration(int((1 + (rand.Float32()*2 - 1)) * 1000))
-			time.Sleep(time.Millisecond * wait)
-			lb.DecConn(id)
-		}(id, lb)
+		wait := time.Millisecond * time.Duration(int((1+(rand.Float32()*2-1))*1000))
+		releases <- release{at: time.Now().Add(wait), wait: wait, id: id}
 	}
+	close(releases)
+	<-done
 
 	sort.Ints(record)
 
-	fmt.Println("Power of Two Load Balancer Test Results")
+	fmt.Printf("%v Load Balancer Test Results\n", name)
 	fmt.Printf("Min: %v\n", record[0])
-	fmt.Printf("25th: %v\n", int((record[6]+record[7])/2))
-	fmt.Printf("50th: %v\n", record[14])
-	fmt.Printf("75th: %v\n", int((record[21]+record[22])/2))
-	fmt.Printf("Max: %v\n", record[29])
+	fmt.Printf("25th: %v\n", record[n/4])
+	fmt.Printf("50th: %v\n", record[n/2])
+	fmt.Printf("75th: %v\n", record[3*n/4])
+	fmt.Printf("Max: %v\n", record[n-1])
+	return record
+}
+
+func TestLBUnhealthyDownstreams(t *testing.T) {
+	n := uint16(4)
+	for _, algorithm := range []string{PowerOfTwo, RoundRobin, LeastConn, Random, PeakEWMA, RingHash, Maglev} {
+		lb, err := New(algorithm, testDownstreams(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lb.MarkUnhealthy(0)
+		lb.MarkUnhealthy(2)
+		for i := 0; i < 1000; i++ {
+			id := lb.GetDownstream(WithHashKey(context.Background(), strconv.Itoa(i)))
+			if id >= n {
+				t.Fatalf("%v: invalid downstream %v", algorithm, id)
+			}
+			// the randomized algorithms may give up after a few attempts
+			if id%2 == 0 && (algorithm == RoundRobin || algorithm == LeastConn || algorithm == RingHash || algorithm == Maglev) {
+				t.Fatalf("%v: chose unhealthy downstream %v", algorithm, id)
+			}
+		}
+	}
+
+	if _, err := New("fastest", nil); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+func TestEmptyLB(t *testing.T) {
+	for _, algorithm := range []string{PowerOfTwo, RoundRobin, LeastConn, Random, PeakEWMA, RingHash, Maglev} {
+		lb, err := New(algorithm, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := lb.GetDownstream(WithHashKey(context.Background(), "key"))
+		if err := lb.IncConn(id); err == nil {
+			t.Errorf("%v: expected the downstream of an empty balancer to be refused", algorithm)
+		}
+	}
+}
+
+func TestLeastConnLBPicksFewestConnections(t *testing.T) {
+	lb := NewLeastConnLoadBalancer(3)
+	lb.IncConn(0)
+	lb.IncConn(0)
+	lb.IncConn(2)
+	for i := 0; i < 100; i++ {
+		if id := lb.GetDownstream(context.Background()); id != 1 {
+			t.Fatalf("Expected downstream 1, got %v", id)
+		}
+	}
+}
+
+func TestPeakEWMALBAvoidsSlowDownstream(t *testing.T) {
+	lb := NewPeakEWMALoadBalancer(2)
+	lb.ObserveLatency(0, time.Second)
+	lb.ObserveLatency(1, time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if id := lb.GetDownstream(context.Background()); id != 1 {
+			t.Fatalf("Expected the fast downstream, got %v", id)
+		}
+	}
+
+	// a faster observation only lowers the average gradually
+	lb.ObserveLatency(0, time.Millisecond)
+	if lb.cost(0) <= lb.cost(1) {
+		t.Error("Expected the slow downstream to still cost more")
+	}
 }
 
 func TestLBAtomicIncDec(t *testing.T) {
@@ -111,3 +300,177 @@ func BenchmarkContentionAtomicInc(b *testing.B) {
 		}
 	})
 }
+
+func TestWeightedPowOfTwoLB(t *testing.T) {
+	lb := NewWeightedPowerOfTwoLoadBalancer([]uint32{1, 3, 0})
+	record := make([]int, 3)
+
+	for i := 0; i < 100000; i++ {
+		record[lb.GetDownstream(context.Background())]++
+	}
+
+	if record[2] != 0 {
+		t.Errorf("Downstream with weight 0 was chosen %v times", record[2])
+	}
+	ratio := float64(record[1]) / float64(record[0])
+	if ratio < 2.7 || ratio > 3.3 {
+		t.Errorf("Expected traffic ratio close to 3, got %v", ratio)
+	}
+
+	lb.SetWeight(1, 1)
+	lb.SetWeight(2, 2)
+	record = make([]int, 3)
+	for i := 0; i < 100000; i++ {
+		record[lb.GetDownstream(context.Background())]++
+	}
+	ratio = float64(record[2]) / float64(record[0])
+	if ratio < 1.8 || ratio > 2.2 {
+		t.Errorf("Expected traffic ratio close to 2 after reweighting, got %v", ratio)
+	}
+}
+
+func TestWeightedPowOfTwoLBNormalizesLoad(t *testing.T) {
+	lb := NewWeightedPowerOfTwoLoadBalancer([]uint32{1, 4})
+	for i := 0; i < 3; i++ {
+		lb.IncConn(0)
+		lb.IncConn(1)
+	}
+
+	// 3 connections is a full load for weight 1 but not for weight 4, and
+	// the two candidates always differ
+	for i := 0; i < 1000; i++ {
+		if id := lb.GetDownstream(context.Background()); id != 1 {
+			t.Fatalf("Unexpected downstream %v", id)
+		}
+	}
+
+	if err := lb.SetWeight(2, 1); err == nil {
+		t.Error("Expected an error for an invalid id")
+	}
+}
+
+func testDownstreams(n uint16) []DownstreamConfig {
+	downstreams := make([]DownstreamConfig, n)
+	for i := range downstreams {
+		downstreams[i] = DownstreamConfig{Name: "server_" + strconv.Itoa(i), Weight: 1}
+	}
+	return downstreams
+}
+
+func TestHashingLBs(t *testing.T) {
+	n := uint16(10)
+	keys := 10000
+	for _, algorithm := range []string{RingHash, Maglev} {
+		lb, _ := New(algorithm, testDownstreams(n))
+		before := make([]uint16, keys)
+		record := make([]int, n)
+		for i := range before {
+			before[i] = lb.GetDownstream(WithHashKey(context.Background(), "key-"+strconv.Itoa(i)))
+			record[before[i]]++
+		}
+
+		// every downstream should own a reasonable share of the keys
+		sort.Ints(record)
+		if record[0] < keys/int(n)/2 || record[n-1] > keys/int(n)*2 {
+			t.Errorf("%v: uneven key distribution %v", algorithm, record)
+		}
+
+		// a downstream with the same name owns the same keys in a new balancer
+		same, _ := New(algorithm, testDownstreams(n))
+		for i := range before {
+			if id := same.GetDownstream(WithHashKey(context.Background(), "key-"+strconv.Itoa(i))); id != before[i] {
+				t.Fatalf("%v: key-%v moved from %v to %v in an identical balancer", algorithm, i, before[i], id)
+			}
+		}
+
+		// only the keys of the unhealthy downstream should move
+		lb.MarkUnhealthy(3)
+		moved := 0
+		for i := range before {
+			id := lb.GetDownstream(WithHashKey(context.Background(), "key-"+strconv.Itoa(i)))
+			if id == 3 {
+				t.Fatalf("%v: key-%v still routed to the unhealthy downstream", algorithm, i)
+			}
+			if id != before[i] {
+				moved++
+				if before[i] != 3 && algorithm == RingHash {
+					t.Fatalf("%v: key-%v moved from healthy downstream %v", algorithm, i, before[i])
+				}
+			}
+		}
+		// maglev may move a handful of other keys
+		if moved > keys/int(n)*2 {
+			t.Errorf("%v: %v keys moved after marking one downstream unhealthy", algorithm, moved)
+		}
+
+		lb.MarkHealthy(3)
+		for i := range before {
+			if id := lb.GetDownstream(WithHashKey(context.Background(), "key-"+strconv.Itoa(i))); id != before[i] {
+				t.Fatalf("%v: key-%v did not return to %v after recovery", algorithm, i, before[i])
+			}
+		}
+	}
+}
+
+func TestZeroWeights(t *testing.T) {
+	for _, algorithm := range []string{PowerOfTwo, RingHash} {
+		// a downstream with weight 0 gets no new traffic
+		lb, _ := New(algorithm, []DownstreamConfig{{Name: "a", Weight: 1}, {Name: "b", Weight: 0}, {Name: "c", Weight: 2}})
+		for i := 0; i < 10000; i++ {
+			if id := lb.GetDownstream(WithHashKey(context.Background(), "key-"+strconv.Itoa(i))); id == 1 {
+				t.Fatalf("%v: downstream with weight 0 was chosen for key-%v", algorithm, i)
+			}
+		}
+
+		// downstreams that all have weight 0 share the traffic evenly
+		lb, _ = New(algorithm, []DownstreamConfig{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+		record := make([]int, 3)
+		for i := 0; i < 30000; i++ {
+			record[lb.GetDownstream(WithHashKey(context.Background(), "key-"+strconv.Itoa(i)))]++
+		}
+		for id, count := range record {
+			if count < 9000 || count > 11000 {
+				t.Errorf("%v: expected downstream %v to get about a third of the traffic, got %v", algorithm, id, record)
+			}
+		}
+	}
+}
+
+func TestRingHashLBCapsWeight(t *testing.T) {
+	lb := NewRingHashLoadBalancer([]DownstreamConfig{{Name: "a", Weight: 1 << 30}, {Name: "b", Weight: 1}})
+	if points := len(lb.ring); points != (MaxWeight+1)*ringHashPointsPerWeight {
+		t.Errorf("Expected the weight to be capped at %v, got %v points", MaxWeight, points)
+	}
+}
+
+func TestUpdateCarriesState(t *testing.T) {
+	previous := NewPeakEWMALoadBalancer(2)
+	previousIDs := map[string]uint16{"a": 0, "b": 1}
+	previous.IncConn(0)
+	previous.ObserveLatency(0, time.Second)
+
+	// a was moved to id 1, b was removed and c is new
+	lb, err := Update(previous, previousIDs, PeakEWMA, []DownstreamConfig{{Name: "c"}, {Name: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := lb.(*PeakEWMALoadBalancer)
+	if connections := updated.getConnections(); connections[0] != 0 || connections[1] != 1 {
+		t.Errorf("Expected the connection of a to be carried over, got %v", connections)
+	}
+	if updated.cost(1) <= updated.cost(0) {
+		t.Error("Expected the latency of a to be carried over")
+	}
+	// the request in flight on the previous balancer finishes
+	previous.DecConn(0)
+	if connections := updated.getConnections(); connections[1] != 0 {
+		t.Errorf("Expected the connection count to be shared, got %v", connections)
+	}
+
+	// the connection counts carry over to another algorithm
+	previous.IncConn(1)
+	lb, _ = Update(previous, previousIDs, LeastConn, []DownstreamConfig{{Name: "b"}})
+	if connections := lb.(*LeastConnLoadBalancer).getConnections(); connections[0] != 1 {
+		t.Errorf("Expected the connection of b to be carried over, got %v", connections)
+	}
+}
@@ -0,0 +1,40 @@
+package loadbalancer
+
+import (
+	"context"
+	"math/rand"
+)
+
+// LeastConnLoadBalancer scans every downstream for the one with the fewest
+// active connections. Unlike the power of two balancer this is exact, at the
+// cost of a full scan per request
+type LeastConnLoadBalancer struct {
+	downstreams
+}
+
+// NewLeastConnLoadBalancer makes a LeastConnLoadBalancer and returns it
+func NewLeastConnLoadBalancer(n uint16) *LeastConnLoadBalancer {
+	return &LeastConnLoadBalancer{downstreams: newDownstreams(n)}
+}
+
+// GetDownstream returns the healthy downstream with the fewest connections.
+// The scan starts at a random offset so ties are spread out
+func (lb *LeastConnLoadBalancer) GetDownstream(ctx context.Context) uint16 {
+	if lb.n == 0 {
+		return 0
+	}
+	first := uint16(rand.Intn(int(lb.n)))
+	id := first
+	found := false
+	var min uint32
+	for i := uint16(0); i < lb.n; i++ {
+		candidate := (first + i) % lb.n
+		if !lb.isHealthy(candidate) {
+			continue
+		}
+		if conns := lb.numConnections(candidate); !found || conns < min {
+			id, min, found = candidate, conns, true
+		}
+	}
+	return id
+}
@@ -1,5 +1,22 @@
 package loadbalancer
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Load balancing algorithms selectable with New
+const (
+	PowerOfTwo = "p2c"
+	RoundRobin = "round_robin"
+	LeastConn  = "least_conn"
+	Random     = "random"
+	PeakEWMA   = "p2c_peak_ewma"
+	RingHash   = "ring_hash"
+	Maglev     = "maglev"
+)
+
 // LoadBalancer interface defines the functions
 // the load balancer needs to implement
 type LoadBalancer interface {
@@ -7,9 +24,88 @@ type LoadBalancer interface {
 	DecConn(id uint16) error
 	IncConn(id uint16) error
 
-	// proxy will call this to determine where to route request
-	GetDownstream() uint16
+	// proxy will call this to determine where to route request, ctx carries
+	// the request's hash key for the hashing load balancers. Without
+	// downstreams it returns 0, which IncConn and DecConn refuse
+	GetDownstream(ctx context.Context) uint16
 
 	MarkHealthy(id uint16)
 	MarkUnhealthy(id uint16)
 }
+
+// WeightedLoadBalancer is a LoadBalancer whose downstreams can be
+// weighted, and reweighted at runtime
+type WeightedLoadBalancer interface {
+	LoadBalancer
+
+	SetWeight(id uint16, weight uint32) error
+	Weight(id uint16) uint32
+}
+
+// LatencyObserver is implemented by load balancers that take the latency of
+// the downstreams into account
+type LatencyObserver interface {
+	ObserveLatency(id uint16, latency time.Duration)
+}
+
+// MaxWeight is the largest weight of a downstream. The ring hash balancer
+// places a number of points per unit of weight, so this bounds its size
+const MaxWeight = 1000
+
+// DownstreamConfig describes a downstream to New. The hashing load balancers
+// place downstreams by name, so keys keep their downstream across reloads
+type DownstreamConfig struct {
+	Name   string
+	Weight uint32
+}
+
+// New makes a load balancer using the named algorithm with the given
+// downstreams, whose ids are their index. Weights are used by the p2c and
+// ring hash algorithms and ignored by the others
+func New(algorithm string, downstreams []DownstreamConfig) (LoadBalancer, error) {
+	n := uint16(len(downstreams))
+	switch algorithm {
+	case "", PowerOfTwo:
+		weights := make([]uint32, n)
+		for i, downstream := range downstreams {
+			weights[i] = downstream.Weight
+		}
+		return NewWeightedPowerOfTwoLoadBalancer(weights), nil
+	case RoundRobin:
+		return NewRoundRobinLoadBalancer(n), nil
+	case LeastConn:
+		return NewLeastConnLoadBalancer(n), nil
+	case Random:
+		return NewRandomLoadBalancer(n), nil
+	case PeakEWMA:
+		return NewPeakEWMALoadBalancer(n), nil
+	case RingHash:
+		return NewRingHashLoadBalancer(downstreams), nil
+	case Maglev:
+		return NewMaglevLoadBalancer(downstreams), nil
+	}
+	return nil, fmt.Errorf("Unknown load balancing algorithm: %q", algorithm)
+}
+
+// Update makes a load balancer like New that replaces previous, whose
+// downstreams keep the state of the downstreams of previous with the same
+// name: the connection counts are shared, so requests still in flight on
+// previous are counted, and the latency averages of the peak EWMA balancer
+// carry over. previousIDs maps the names of the downstreams of previous to
+// their ids, previous may be nil
+func Update(previous LoadBalancer, previousIDs map[string]uint16, algorithm string, downstreams []DownstreamConfig) (LoadBalancer, error) {
+	lb, err := New(algorithm, downstreams)
+	if err != nil || previous == nil {
+		return lb, err
+	}
+	c, ok := lb.(carrier)
+	if !ok {
+		return lb, nil
+	}
+	for id, downstream := range downstreams {
+		if previousID, ok := previousIDs[downstream.Name]; ok {
+			c.carry(previous, uint16(id), previousID)
+		}
+	}
+	return lb, nil
+}
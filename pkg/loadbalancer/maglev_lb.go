@@ -0,0 +1,113 @@
+package loadbalancer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// maglevTableSize must be prime and much larger than the number of downstreams
+const maglevTableSize = 65537
+
+// MaglevLoadBalancer implements Maglev hashing from Google's Maglev paper.
+// Every downstream has a preference order over a fixed size lookup table
+// derived from its name, and the table is filled by letting the healthy
+// downstreams take turns claiming their next preferred slot. Each downstream
+// ends up with an almost equal share of the table, and when one is marked
+// unhealthy the table is rebuilt with few slots changing hands beyond its own
+type MaglevLoadBalancer struct {
+	downstreams
+	offsets []uint64
+	skips   []uint64
+	// table holds the current []uint16 lookup table
+	table   atomic.Value
+	tableMu sync.Mutex
+}
+
+// NewMaglevLoadBalancer makes a MaglevLoadBalancer and returns it, weights
+// are ignored
+func NewMaglevLoadBalancer(downstreamConfigs []DownstreamConfig) *MaglevLoadBalancer {
+	n := uint16(len(downstreamConfigs))
+	lb := &MaglevLoadBalancer{
+		downstreams: newDownstreams(n),
+		offsets:     make([]uint64, n),
+		skips:       make([]uint64, n),
+	}
+	for id, downstream := range downstreamConfigs {
+		lb.offsets[id] = hash64(downstream.Name+"-offset") % maglevTableSize
+		lb.skips[id] = hash64(downstream.Name+"-skip")%(maglevTableSize-1) + 1
+	}
+	lb.populate()
+	return lb
+}
+
+// MarkHealthy allows health monitor to tell LB when a downstream id becomes healthy
+func (lb *MaglevLoadBalancer) MarkHealthy(id uint16) {
+	if !lb.isHealthy(id) {
+		lb.downstreams.MarkHealthy(id)
+		lb.populate()
+	}
+}
+
+// MarkUnhealthy allows health monitor to tell LB when a downstream id becomes unhealthy
+func (lb *MaglevLoadBalancer) MarkUnhealthy(id uint16) {
+	if lb.isHealthy(id) {
+		lb.downstreams.MarkUnhealthy(id)
+		lb.populate()
+	}
+}
+
+// populate rebuilds the lookup table from the healthy downstreams, or from
+// all of them if none are healthy
+func (lb *MaglevLoadBalancer) populate() {
+	lb.tableMu.Lock()
+	defer lb.tableMu.Unlock()
+
+	var ids []uint16
+	for id := uint16(0); id < lb.n; id++ {
+		if lb.isHealthy(id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		for id := uint16(0); id < lb.n; id++ {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		lb.table.Store([]uint16(nil))
+		return
+	}
+
+	table := make([]uint16, maglevTableSize)
+	filled := make([]bool, maglevTableSize)
+	next := make([]uint64, len(ids))
+	for n := 0; ; {
+		for i, id := range ids {
+			slot := (lb.offsets[id] + next[i]*lb.skips[id]) % maglevTableSize
+			for filled[slot] {
+				next[i]++
+				slot = (lb.offsets[id] + next[i]*lb.skips[id]) % maglevTableSize
+			}
+			table[slot] = id
+			filled[slot] = true
+			next[i]++
+			n++
+			if n == maglevTableSize {
+				lb.table.Store(table)
+				return
+			}
+		}
+	}
+}
+
+// GetDownstream returns the downstream owning the hash key in ctx, or a
+// random one if there is no key
+func (lb *MaglevLoadBalancer) GetDownstream(ctx context.Context) uint16 {
+	key, ok := HashKey(ctx)
+	table := lb.table.Load().([]uint16)
+	if !ok || len(table) == 0 {
+		return lb.randomHealthy()
+	}
+	return table[hash64(key)%maglevTableSize]
+}
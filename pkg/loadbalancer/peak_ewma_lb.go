@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// peakEWMADecay is the time constant of the moving average, an
+	// observation's influence halves roughly every 7 seconds
+	peakEWMADecay = 10 * time.Second
+	// peakEWMADefaultRTT is assumed for downstreams that have no
+	// observations yet, so that they are neither avoided nor flooded
+	peakEWMADefaultRTT = 10 * time.Millisecond
+)
+
+// PeakEWMALoadBalancer is the power of two choices over a cost of latency
+// times load, as in Finagle and Linkerd. Each downstream keeps an
+// exponentially weighted moving average of its latency which jumps straight
+// to any higher observation, so a slow downstream is avoided immediately and
+// only trusted again as the average decays
+type PeakEWMALoadBalancer struct {
+	downstreams
+	ewma []*peakEWMA
+}
+
+type peakEWMA struct {
+	mu    sync.Mutex
+	value float64 // nanoseconds
+	stamp time.Time
+}
+
+// NewPeakEWMALoadBalancer makes a PeakEWMALoadBalancer and returns it
+func NewPeakEWMALoadBalancer(n uint16) *PeakEWMALoadBalancer {
+	lb := &PeakEWMALoadBalancer{
+		downstreams: newDownstreams(n),
+		ewma:        make([]*peakEWMA, n),
+	}
+	now := time.Now()
+	for i := range lb.ewma {
+		lb.ewma[i] = &peakEWMA{value: float64(peakEWMADefaultRTT), stamp: now}
+	}
+	return lb
+}
+
+// carry also shares the latency average of previousID if previous is a
+// PeakEWMALoadBalancer too
+func (lb *PeakEWMALoadBalancer) carry(previous LoadBalancer, id, previousID uint16) {
+	lb.downstreams.carry(previous, id, previousID)
+	if prev, ok := previous.(*PeakEWMALoadBalancer); ok && id < lb.n && previousID < prev.n {
+		lb.ewma[id] = prev.ewma[previousID]
+	}
+}
+
+// ObserveLatency records the latency of a response from a downstream
+func (lb *PeakEWMALoadBalancer) ObserveLatency(id uint16, latency time.Duration) {
+	if id >= lb.n {
+		return
+	}
+	e := lb.ewma[id]
+	rtt := float64(latency)
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if rtt > e.value {
+		e.value = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(peakEWMADecay))
+		e.value = e.value*w + rtt*(1-w)
+	}
+	e.stamp = now
+}
+
+func (lb *PeakEWMALoadBalancer) cost(id uint16) float64 {
+	e := lb.ewma[id]
+	e.mu.Lock()
+	value := e.value
+	e.mu.Unlock()
+	return value * float64(lb.numConnections(id)+1)
+}
+
+// GetDownstream compares two random downstreams and returns the cheaper one
+func (lb *PeakEWMALoadBalancer) GetDownstream(ctx context.Context) uint16 {
+	if lb.n == 0 {
+		return 0
+	}
+	var id uint16
+	for i := 0; i < 5; i++ {
+		id1 := uint16(rand.Intn(int(lb.n)))
+		id2 := uint16(rand.Intn(int(lb.n)))
+
+		if id1 == id2 {
+			id2 = (id2 + lb.n/2) % lb.n
+		}
+
+		if lb.cost(id1) > lb.cost(id2) {
+			id = id2
+		} else {
+			id = id1
+		}
+		if lb.isHealthy(id) {
+			break
+		}
+	}
+	return id
+}
@@ -1,91 +1,141 @@
 package loadbalancer
 
 import (
+	"context"
 	"errors"
 	"math/rand"
+	"sort"
+	"sync"
 	"sync/atomic"
 )
 
 // PowerOfTwoLoadBalancer implementation
 type PowerOfTwoLoadBalancer struct {
-	// number of ports
-	n           uint16
-	connections []uint32
-	idUnhealthy []uint32
+	downstreams
+	weights []uint32
+	// cumulative holds the prefix sums of weights as a []uint64, it is
+	// rebuilt and swapped whenever a weight changes
+	cumulative atomic.Value
+	weightsMu  sync.Mutex
 }
 
 // NewPowerOfTwoLoadBalancer makes a PowerOfTwoLoadBalancer and returns it
 func NewPowerOfTwoLoadBalancer(n uint16) *PowerOfTwoLoadBalancer {
-	return &PowerOfTwoLoadBalancer{
-		n:           n,
-		connections: make([]uint32, n),
-		idUnhealthy: make([]uint32, n),
+	weights := make([]uint32, n)
+	for i := range weights {
+		weights[i] = 1
 	}
+	return NewWeightedPowerOfTwoLoadBalancer(weights)
 }
 
-// MarkHealthy allows health monitor to tell LB when a downstream id becomes healthy
-func (lb *PowerOfTwoLoadBalancer) MarkHealthy(id uint16) {
-	atomic.StoreUint32(&lb.idUnhealthy[id], 0)
-}
-
-// MarkUnhealthy allows health monitor to tell LB when a downstream id becomes unhealthy
-func (lb *PowerOfTwoLoadBalancer) MarkUnhealthy(id uint16) {
-	atomic.StoreUint32(&lb.idUnhealthy[id], 1)
+// NewWeightedPowerOfTwoLoadBalancer makes a PowerOfTwoLoadBalancer whose
+// downstreams are sampled in proportion to their weight
+func NewWeightedPowerOfTwoLoadBalancer(weights []uint32) *PowerOfTwoLoadBalancer {
+	n := uint16(len(weights))
+	lb := &PowerOfTwoLoadBalancer{
+		downstreams: newDownstreams(n),
+		weights:     make([]uint32, n),
+	}
+	copy(lb.weights, weights)
+	lb.updateCumulative()
+	return lb
 }
 
-// DecConn decrements the number of connections of a particular downstream
-func (lb *PowerOfTwoLoadBalancer) DecConn(id uint16) error {
+// SetWeight changes the weight of a downstream, which can be used to
+// gradually shift traffic. A weight of zero stops new requests to it
+func (lb *PowerOfTwoLoadBalancer) SetWeight(id uint16, weight uint32) error {
 	if id < 0 || id >= lb.n {
 		return errors.New("Invalid id")
 	}
-	if atomic.LoadUint32(&lb.connections[id]) <= 0 {
-		return errors.New("Count cannot be less than zero")
-	}
-	// this will decrement the value: https:// golang.org/pkg/sync/atomic/#AddUint32
-	atomic.AddUint32(&lb.connections[id], ^uint32(0))
+	lb.weightsMu.Lock()
+	defer lb.weightsMu.Unlock()
+	atomic.StoreUint32(&lb.weights[id], weight)
+	lb.updateCumulative()
 	return nil
 }
 
-// IncConn increments the number of connections of a particular downstream
-func (lb *PowerOfTwoLoadBalancer) IncConn(id uint16) error {
-	if id < 0 || id >= lb.n {
-		return errors.New("Invalid id")
+// Weight returns the current weight of a downstream
+func (lb *PowerOfTwoLoadBalancer) Weight(id uint16) uint32 {
+	return atomic.LoadUint32(&lb.weights[id])
+}
+
+func (lb *PowerOfTwoLoadBalancer) updateCumulative() {
+	cumulative := make([]uint64, lb.n)
+	var sum uint64
+	for i := range lb.weights {
+		sum += uint64(atomic.LoadUint32(&lb.weights[i]))
+		cumulative[i] = sum
 	}
+	lb.cumulative.Store(cumulative)
+}
 
-	atomic.AddUint32(&lb.connections[id], uint32(1))
-	return nil
+// sample picks a random downstream with probability proportional to its
+// weight, or uniformly if every weight is 0
+func (lb *PowerOfTwoLoadBalancer) sample() uint16 {
+	cumulative := lb.cumulative.Load().([]uint64)
+	total := cumulative[len(cumulative)-1]
+	if total == 0 {
+		return uint16(rand.Intn(int(lb.n)))
+	}
+	r := uint64(rand.Int63n(int64(total)))
+	return uint16(sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > r }))
+}
+
+// sampleExcluding picks a random downstream other than exclude with
+// probability proportional to its weight, so the two candidates always
+// differ when there is more than one downstream
+func (lb *PowerOfTwoLoadBalancer) sampleExcluding(exclude uint16) uint16 {
+	if lb.n < 2 {
+		return exclude
+	}
+	cumulative := lb.cumulative.Load().([]uint64)
+	var start uint64
+	if exclude > 0 {
+		start = cumulative[exclude-1]
+	}
+	weight := cumulative[exclude] - start
+	total := cumulative[len(cumulative)-1] - weight
+	if total == 0 {
+		id := uint16(rand.Intn(int(lb.n) - 1))
+		if id >= exclude {
+			id++
+		}
+		return id
+	}
+	// skip over the range of the excluded downstream
+	r := uint64(rand.Int63n(int64(total)))
+	if r >= start {
+		r += weight
+	}
+	return uint16(sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > r }))
 }
 
 // GetDownstream uses the power of two algorithm to determine which
-// connection to forward request to, returns the id
-func (lb *PowerOfTwoLoadBalancer) GetDownstream() uint16 {
+// connection to forward request to, returns the id. Candidates are sampled
+// by weight and their load is compared relative to their weight
+func (lb *PowerOfTwoLoadBalancer) GetDownstream(ctx context.Context) uint16 {
+	if lb.n == 0 {
+		return 0
+	}
 	var id uint16
 	// limit the number of failed attempts, if we fail numerous times
 	// server likely in shutdown anyways
 	// wanted to have some stopping condition here - not sure if this is best one
 	for i := 0; i < 5; i++ {
-		id1 := uint16(rand.Intn(int(lb.n)))
-		id2 := uint16(rand.Intn(int(lb.n)))
-
-		if id1 == id2 {
-			id2 = (id2 + lb.n/2) % lb.n
-		}
+		id1 := lb.sample()
+		id2 := lb.sampleExcluding(id1)
 
-		if atomic.LoadUint32(&lb.connections[id1]) > atomic.LoadUint32(&lb.connections[id2]) {
+		// conn1/weight1 > conn2/weight2 without the division
+		load1 := uint64(lb.numConnections(id1)) * uint64(atomic.LoadUint32(&lb.weights[id2]))
+		load2 := uint64(lb.numConnections(id2)) * uint64(atomic.LoadUint32(&lb.weights[id1]))
+		if load1 > load2 {
 			id = id2
 		} else {
 			id = id1
 		}
-		if atomic.LoadUint32(&lb.idUnhealthy[id]) == 0 {
+		if lb.isHealthy(id) {
 			break
 		}
 	}
 	return id
 }
-
-// this should only be used for testing
-func (lb *PowerOfTwoLoadBalancer) getConnections() []uint32 {
-	connectionsCopy := make([]uint32, len(lb.connections))
-	copy(connectionsCopy, lb.connections)
-	return connectionsCopy
-}
@@ -0,0 +1,32 @@
+package loadbalancer
+
+import (
+	"context"
+	"math/rand"
+)
+
+// RandomLoadBalancer picks a downstream uniformly at random
+type RandomLoadBalancer struct {
+	downstreams
+}
+
+// NewRandomLoadBalancer makes a RandomLoadBalancer and returns it
+func NewRandomLoadBalancer(n uint16) *RandomLoadBalancer {
+	return &RandomLoadBalancer{downstreams: newDownstreams(n)}
+}
+
+// GetDownstream returns a random downstream, retrying a few times to find a
+// healthy one
+func (lb *RandomLoadBalancer) GetDownstream(ctx context.Context) uint16 {
+	if lb.n == 0 {
+		return 0
+	}
+	var id uint16
+	for i := 0; i < 5; i++ {
+		id = uint16(rand.Intn(int(lb.n)))
+		if lb.isHealthy(id) {
+			break
+		}
+	}
+	return id
+}
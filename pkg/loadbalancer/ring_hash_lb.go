@@ -0,0 +1,66 @@
+package loadbalancer
+
+import (
+	"context"
+	"sort"
+	"strconv"
+)
+
+// ringHashPointsPerWeight is the number of points each unit of weight gets on
+// the ring, more points spread the keys more evenly
+const ringHashPointsPerWeight = 100
+
+// RingHashLoadBalancer is a consistent hash ring. Each downstream is placed
+// on the ring at points derived from its name, and a key goes to the first
+// healthy downstream at or after its own hash. When a downstream becomes
+// unhealthy only its keys move, to the next downstreams along the ring
+type RingHashLoadBalancer struct {
+	downstreams
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	id   uint16
+}
+
+// NewRingHashLoadBalancer makes a RingHashLoadBalancer and returns it. A
+// downstream with weight 0 gets no points on the ring, so it only receives
+// keys when every downstream has weight 0 and they are picked at random.
+// Weights over MaxWeight are treated as MaxWeight
+func NewRingHashLoadBalancer(downstreamConfigs []DownstreamConfig) *RingHashLoadBalancer {
+	lb := &RingHashLoadBalancer{downstreams: newDownstreams(uint16(len(downstreamConfigs)))}
+	for id, downstream := range downstreamConfigs {
+		weight := downstream.Weight
+		if weight > MaxWeight {
+			weight = MaxWeight
+		}
+		for i := 0; i < int(weight)*ringHashPointsPerWeight; i++ {
+			lb.ring = append(lb.ring, ringPoint{
+				hash: hash64(downstream.Name + "-" + strconv.Itoa(i)),
+				id:   uint16(id),
+			})
+		}
+	}
+	sort.Slice(lb.ring, func(i, j int) bool { return lb.ring[i].hash < lb.ring[j].hash })
+	return lb
+}
+
+// GetDownstream returns the downstream owning the hash key in ctx, or a
+// random one if there is no key
+func (lb *RingHashLoadBalancer) GetDownstream(ctx context.Context) uint16 {
+	key, ok := HashKey(ctx)
+	if !ok || len(lb.ring) == 0 {
+		return lb.randomHealthy()
+	}
+
+	hash := hash64(key)
+	start := sort.Search(len(lb.ring), func(i int) bool { return lb.ring[i].hash >= hash })
+	for i := 0; i < len(lb.ring); i++ {
+		point := lb.ring[(start+i)%len(lb.ring)]
+		if lb.isHealthy(point.id) {
+			return point.id
+		}
+	}
+	return lb.ring[start%len(lb.ring)].id
+}
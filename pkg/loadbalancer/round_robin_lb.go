@@ -0,0 +1,34 @@
+package loadbalancer
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// RoundRobinLoadBalancer hands out the downstreams in turn, skipping the
+// unhealthy ones
+type RoundRobinLoadBalancer struct {
+	downstreams
+	next uint32
+}
+
+// NewRoundRobinLoadBalancer makes a RoundRobinLoadBalancer and returns it
+func NewRoundRobinLoadBalancer(n uint16) *RoundRobinLoadBalancer {
+	return &RoundRobinLoadBalancer{downstreams: newDownstreams(n)}
+}
+
+// GetDownstream returns the next healthy downstream in order, or the next
+// downstream if none are healthy
+func (lb *RoundRobinLoadBalancer) GetDownstream(ctx context.Context) uint16 {
+	if lb.n == 0 {
+		return 0
+	}
+	first := uint16((atomic.AddUint32(&lb.next, 1) - 1) % uint32(lb.n))
+	for i := uint16(0); i < lb.n; i++ {
+		id := (first + i) % lb.n
+		if lb.isHealthy(id) {
+			return id
+		}
+	}
+	return first
+}